@@ -0,0 +1,358 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+const maxRequestBodySize = 64 << 10
+
+// errVersionNotFound is returned when planning a migration to a version that
+// is not in the source.
+var errVersionNotFound = errors.New("version not found")
+
+type migrateRequest struct {
+	Database string `json:"database"`
+	// Version to migrate to, up or down. All the pending migrations are
+	// applied when unset.
+	Version *uint `json:"version"`
+	// DryRun reports the resulting state and the migrations that would run,
+	// without running them.
+	DryRun bool `json:"dryRun"`
+}
+
+type forceRequest struct {
+	Database string `json:"database"`
+	Version  *int   `json:"version"`
+	DryRun   bool   `json:"dryRun"`
+}
+
+// plannedMigration is a migration that a dry run reports as to be run. Name
+// is empty for down migrations without a file, which only change the
+// version.
+type plannedMigration struct {
+	Version uint   `json:"version"`
+	Name    string `json:"name,omitempty"`
+}
+
+// migrateTo applies the migrations up or down to the requested version.
+func (s *Server) migrateTo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req migrateRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.lookup(req.Database)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.DryRun {
+		to, planned, err := t.planMigration(req.Version)
+		var dirtyErr migrate.ErrDirty
+		switch {
+		case errors.As(err, &dirtyErr):
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("Database dirty at version %d", dirtyErr.Version))
+			return
+		case errors.Is(err, errVersionNotFound):
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Version %d not found", *req.Version))
+			return
+		case err != nil:
+			slog.Error("Failed to plan the migration", "database", t.name, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to plan the migration")
+			return
+		}
+		s.writeDryRun(w, t, to, planned)
+		return
+	}
+
+	if req.Version == nil {
+		slog.Info("Applying migrations on request", "database", t.name)
+		err = t.m.Up()
+	} else {
+		slog.Info("Migrating on request", "database", t.name, "version", *req.Version)
+		err = t.m.Migrate(*req.Version)
+	}
+	t.invalidateVersion()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.errorCount++
+		slog.Error("Failed to migrate", "database", t.name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to migrate")
+		return
+	}
+
+	s.writeState(w, t)
+}
+
+// force sets the version of the database without running any migration,
+// clearing the dirty flag.
+func (s *Server) force(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req forceRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Version == nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing version")
+		return
+	}
+	// NOTE: -1 forces the database back to no version, as migrate does.
+	if *req.Version < -1 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid version %d", *req.Version))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.lookup(req.Database)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.DryRun {
+		var to *uint
+		if *req.Version >= 0 {
+			v := uint(*req.Version)
+			to = &v
+		}
+		s.writeDryRun(w, t, to, []plannedMigration{})
+		return
+	}
+
+	slog.Warn("Forcing version on request", "database", t.name, "version", *req.Version)
+	err = t.m.Force(*req.Version)
+	t.invalidateVersion()
+	if err != nil {
+		slog.Error("Failed to force version", "database", t.name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to force version")
+		return
+	}
+
+	s.writeState(w, t)
+}
+
+// render re-renders the templates of all the targets, without migrating,
+// reporting the files written and any error.
+func (s *Server) render(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := http.StatusOK
+	results := make(map[string]any, len(s.targets))
+	for _, t := range s.targets {
+		files, err := t.cfg.render()
+		if files == nil {
+			files = []string{}
+		}
+		result := map[string]any{
+			"files": files,
+		}
+		if err != nil {
+			slog.Error("Failed to render the templates", "database", t.name, "err", err)
+			result["error"] = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		if len(s.targets) == 1 && t.name == "" {
+			writeJSON(w, status, result)
+			return
+		}
+		results[t.name] = result
+	}
+
+	writeJSON(w, status, results)
+}
+
+// lookup returns the target with the given name, which can be omitted when
+// a single database is configured.
+func (s *Server) lookup(name string) (*target, error) {
+	if name == "" && len(s.targets) == 1 {
+		return s.targets[0], nil
+	}
+	for _, t := range s.targets {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("missing database")
+	}
+	return nil, fmt.Errorf("unknown database %q", name)
+}
+
+func (s *Server) writeState(w http.ResponseWriter, t *target) {
+	vers, dirty, err := t.m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		slog.Error("Failed to get version", "database", t.name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	state := map[string]any{
+		"version": nil,
+		"dirty":   dirty,
+	}
+	if err == nil {
+		state["version"] = vers
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// planMigration returns the version migrating to the given one, or up when
+// nil, would result in, and the migrations that would run, in order. It fails
+// with migrate.ErrDirty when the database is dirty, and with
+// errVersionNotFound when the version is not in the source.
+func (t *target) planMigration(version *uint) (*uint, []plannedMigration, error) {
+	current, dirty, err := currentVersion(t.m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dirty {
+		return nil, nil, migrate.ErrDirty{Version: int(*current)}
+	}
+
+	sourceURL := t.cfg.migrationsPath()
+	available, err := availableVersions(sourceURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	to := current
+	if version != nil {
+		if !slices.Contains(available, *version) {
+			return nil, nil, fmt.Errorf("version %d: %w", *version, errVersionNotFound)
+		}
+		to = version
+	} else if len(available) > 0 && (current == nil || available[len(available)-1] > *current) {
+		to = &available[len(available)-1]
+	}
+
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	planned := []plannedMigration{}
+	if current == nil || (to != nil && *to > *current) {
+		for _, v := range available {
+			if (current == nil || v > *current) && v <= *to {
+				r, name, err := src.ReadUp(v)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read version %d: %w", v, err)
+				}
+				r.Close()
+				planned = append(planned, plannedMigration{Version: v, Name: name})
+			}
+		}
+		return to, planned, nil
+	}
+
+	for i := len(available) - 1; i >= 0; i-- {
+		if v := available[i]; v <= *current && v > *to {
+			step := plannedMigration{Version: v}
+			r, name, err := src.ReadDown(v)
+			if err == nil {
+				r.Close()
+				step.Name = name
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, nil, fmt.Errorf("failed to read version %d: %w", v, err)
+			}
+			planned = append(planned, step)
+		}
+	}
+	return to, planned, nil
+}
+
+// writeDryRun writes the current state of the database along with the one a
+// dry run would result in, and the migrations it would run.
+func (s *Server) writeDryRun(w http.ResponseWriter, t *target, to *uint, planned []plannedMigration) {
+	current, dirty, err := currentVersion(t.m)
+	if err != nil {
+		slog.Error("Failed to get version", "database", t.name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"dryRun": true,
+		"current": map[string]any{
+			"version": current,
+			"dirty":   dirty,
+		},
+		"version":    to,
+		"dirty":      false,
+		"migrations": planned,
+	})
+}
+
+// decodeJSON strictly decodes the request body into dst, rejecting unknown
+// fields, trailing data and bodies larger than maxRequestBodySize. An empty
+// body leaves dst untouched.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return fmt.Errorf("request body larger than %d bytes", maxBytesErr.Limit)
+		}
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("invalid request body: unexpected data after the JSON object")
+	}
+
+	return nil
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{
+		"error": msg,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
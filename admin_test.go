@@ -0,0 +1,267 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+// adminServer returns a server with a single target, named after the given
+// name, migrating the versions of dir with driver.
+func adminServer(t *testing.T, name, dir string, driver *stubDriver) *Server {
+	t.Helper()
+
+	m, err := migrate.NewWithDatabaseInstance("file://"+dir, "stub", driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	return &Server{targets: []*target{{name: name, cfg: Config{migrations: dir}, m: m}}}
+}
+
+// serveAdmin runs the request to h, returning the status and the decoded
+// body of the response.
+func serveAdmin(t *testing.T, h http.HandlerFunc, method, body string) (int, map[string]any) {
+	t.Helper()
+
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode the response: %v", err)
+	}
+	return w.Code, resp
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    migrateRequest
+		wantErr string
+	}{
+		{"empty", "", migrateRequest{}, ""},
+		{"request", `{"database": "app", "dryRun": true}`, migrateRequest{Database: "app", DryRun: true}, ""},
+		{"trailing space", "{\"database\": \"app\"}\n", migrateRequest{Database: "app"}, ""},
+		{"unknown field", `{"database": "app", "versoin": 3}`, migrateRequest{}, `invalid request body: json: unknown field "versoin"`},
+		{"trailing data", `{"database": "app"} {"database": "other"}`, migrateRequest{}, "invalid request body: unexpected data after the JSON object"},
+		{"trailing garbage", `{"database": "app"}]`, migrateRequest{}, "invalid request body: unexpected data after the JSON object"},
+		{"malformed", `{"database": `, migrateRequest{}, "invalid request body: unexpected EOF"},
+		{"wrong type", `{"version": "3"}`, migrateRequest{}, "invalid request body: json: cannot unmarshal string into Go struct field migrateRequest.version of type uint"},
+		{"too large", `{"database": "` + strings.Repeat("a", maxRequestBodySize) + `"}`, migrateRequest{}, "request body larger than 65536 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/migrate", strings.NewReader(tt.body))
+			var got migrateRequest
+			err := decodeJSON(httptest.NewRecorder(), r, &got)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("decodeJSON() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeJSON() = %v", err)
+			}
+			if got.Database != tt.want.Database || got.DryRun != tt.want.DryRun || got.Version != nil {
+				t.Errorf("decodeJSON() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForce(t *testing.T) {
+	dir, _ := migrationsDir(t, 1, 2, 3)
+
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		wantStatus  int
+		wantError   string
+		wantVersion int
+	}{
+		{"method", http.MethodGet, `{"version": 2}`, http.StatusMethodNotAllowed, "Method not allowed", 3},
+		{"unknown field", http.MethodPost, `{"version": 2, "force": true}`, http.StatusBadRequest, `invalid request body: json: unknown field "force"`, 3},
+		{"missing version", http.MethodPost, `{}`, http.StatusBadRequest, "Missing version", 3},
+		{"below no version", http.MethodPost, `{"version": -2}`, http.StatusBadRequest, "Invalid version -2", 3},
+		{"unknown database", http.MethodPost, `{"database": "other", "version": 2}`, http.StatusBadRequest, `unknown database "other"`, 3},
+		{"version", http.MethodPost, `{"version": 2}`, http.StatusOK, "", 2},
+		{"no version", http.MethodPost, `{"version": -1}`, http.StatusOK, "", database.NilVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &stubDriver{version: 3, dirty: true}
+			s := adminServer(t, "", dir, driver)
+
+			status, resp := serveAdmin(t, s.force, tt.method, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantError != "" && resp["error"] != tt.wantError {
+				t.Errorf("error = %v, want %q", resp["error"], tt.wantError)
+			}
+			if driver.version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", driver.version, tt.wantVersion)
+			}
+			if tt.wantStatus == http.StatusOK && (driver.dirty || resp["dirty"] != false) {
+				t.Errorf("dirty = %t, response %v, want clean", driver.dirty, resp)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir, _ := migrationsDir(t, 1)
+	single := adminServer(t, "", dir, &stubDriver{version: database.NilVersion})
+	named := adminServer(t, "app", dir, &stubDriver{version: database.NilVersion})
+	named.targets = append(named.targets, &target{name: "billing"})
+
+	tests := []struct {
+		name    string
+		s       *Server
+		lookup  string
+		want    string
+		wantErr string
+	}{
+		{"single", single, "", "", ""},
+		{"named", named, "billing", "billing", ""},
+		{"missing", named, "", "", "missing database"},
+		{"unknown", named, "other", "", `unknown database "other"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.s.lookup(tt.lookup)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("lookup() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookup() = %v", err)
+			}
+			if got.name != tt.want {
+				t.Errorf("lookup() = %q, want %q", got.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanMigration(t *testing.T) {
+	dir, _ := migrationsDir(t, 1, 2, 3)
+	if err := os.WriteFile(filepath.Join(dir, "3_v3.down.sql"), []byte("SELECT 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	one, two, three, four := uint(1), uint(2), uint(3), uint(4)
+	tests := []struct {
+		name    string
+		current int
+		dirty   bool
+		version *uint
+		want    *uint
+		planned []plannedMigration
+		wantErr error
+	}{
+		{"up from no version", database.NilVersion, false, nil, &three, []plannedMigration{{1, "v1"}, {2, "v2"}, {3, "v3"}}, nil},
+		{"up", 1, false, nil, &three, []plannedMigration{{2, "v2"}, {3, "v3"}}, nil},
+		{"up to date", 3, false, nil, &three, []plannedMigration{}, nil},
+		{"up to version", 1, false, &two, &two, []plannedMigration{{2, "v2"}}, nil},
+		{"same version", 2, false, &two, &two, []plannedMigration{}, nil},
+		{"down", 3, false, &one, &one, []plannedMigration{{3, "v3"}, {2, ""}}, nil},
+		{"unknown version", 1, false, &four, nil, nil, errVersionNotFound},
+		{"dirty", 2, true, nil, nil, nil, migrate.ErrDirty{Version: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &stubDriver{version: tt.current, dirty: tt.dirty}
+			s := adminServer(t, "", dir, driver)
+
+			to, planned, err := s.targets[0].planMigration(tt.version)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("planMigration() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planMigration() = %v", err)
+			}
+			if !reflect.DeepEqual(to, tt.want) {
+				t.Errorf("to = %v, want %v", to, tt.want)
+			}
+			if !reflect.DeepEqual(planned, tt.planned) {
+				t.Errorf("planned = %v, want %v", planned, tt.planned)
+			}
+			if driver.runs != 0 || driver.version != tt.current {
+				t.Errorf("ran %d, version %d, want nothing changed", driver.runs, driver.version)
+			}
+		})
+	}
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+	dir, _ := migrationsDir(t, 1, 2, 3)
+
+	tests := []struct {
+		name       string
+		handler    func(*Server) http.HandlerFunc
+		body       string
+		dirty      bool
+		wantStatus int
+		want       string
+	}{
+		{"migrate", func(s *Server) http.HandlerFunc { return s.migrateTo }, `{"dryRun": true}`, false, http.StatusOK,
+			`{"current":{"dirty":false,"version":1},"dirty":false,"dryRun":true,"migrations":[{"name":"v2","version":2},{"name":"v3","version":3}],"version":3}`},
+		{"migrate current version", func(s *Server) http.HandlerFunc { return s.migrateTo }, `{"version": 1, "dryRun": true}`, false, http.StatusOK,
+			`{"current":{"dirty":false,"version":1},"dirty":false,"dryRun":true,"migrations":[],"version":1}`},
+		{"migrate unknown version", func(s *Server) http.HandlerFunc { return s.migrateTo }, `{"version": 4, "dryRun": true}`, false, http.StatusBadRequest,
+			`{"error":"Version 4 not found"}`},
+		{"migrate dirty", func(s *Server) http.HandlerFunc { return s.migrateTo }, `{"dryRun": true}`, true, http.StatusConflict,
+			`{"error":"Database dirty at version 1"}`},
+		{"force", func(s *Server) http.HandlerFunc { return s.force }, `{"version": 3, "dryRun": true}`, true, http.StatusOK,
+			`{"current":{"dirty":true,"version":1},"dirty":false,"dryRun":true,"migrations":[],"version":3}`},
+		{"force no version", func(s *Server) http.HandlerFunc { return s.force }, `{"version": -1, "dryRun": true}`, false, http.StatusOK,
+			`{"current":{"dirty":false,"version":1},"dirty":false,"dryRun":true,"migrations":[],"version":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &stubDriver{version: 1, dirty: tt.dirty}
+			s := adminServer(t, "", dir, driver)
+
+			status, resp := serveAdmin(t, tt.handler(s), http.MethodPost, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			got, err := json.Marshal(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("response = %s, want %s", got, tt.want)
+			}
+			if driver.runs != 0 || driver.version != 1 || driver.dirty != tt.dirty {
+				t.Errorf("ran %d, version %d, dirty %t, want nothing changed", driver.runs, driver.version, driver.dirty)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package migrator
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var archiveSuffixes = []string{".tar.gz", ".tgz", ".zip"}
+
+func isArchiveSource(migrations string) bool {
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(migrations, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractArchive extracts the .tar.gz or .zip archive at path into a new
+// temporary directory and returns it, checking that it holds migrations. The
+// directory is to be removed by the caller once done with the migrations.
+func extractArchive(path string) (string, error) {
+	dir, err := os.MkdirTemp("", "migrator-archive-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create extraction directory: %w", err)
+	}
+
+	if strings.HasSuffix(path, ".zip") {
+		err = extractZip(path, dir)
+	} else {
+		err = extractTarGz(path, dir)
+	}
+	if err == nil {
+		err = checkSource(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to extract %s: %w", path, err)
+	}
+
+	slog.Info("Extracted migrations archive", "archive", path, "dir", dir)
+	return dir, nil
+}
+
+// archivePath returns the path of the entry name inside dir, refusing the
+// names that would end up outside of it.
+func archivePath(dir, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("entry %q escapes the extraction directory", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func extractTarGz(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// NOTE: git archive starts the tarballs with a pax global header,
+		// holding the commit, which is no entry to extract.
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		dst, err := archivePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeArchiveFile(dst, tr); err != nil {
+				return err
+			}
+		default:
+			// NOTE: links could point outside of the extraction directory.
+			return fmt.Errorf("entry %q is not a regular file or directory", hdr.Name)
+		}
+	}
+}
+
+func extractZip(path, dir string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		dst, err := archivePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = writeArchiveFile(dst, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("entry %q is not a regular file or directory", zf.Name)
+		}
+	}
+
+	return nil
+}
+
+func writeArchiveFile(dst string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,146 @@
+package migrator
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file of an archive written by writeZip and writeTarGz,
+// which is a symbolic link to target when it is set, and a directory when its
+// name ends with a slash.
+type archiveEntry struct {
+	name    string
+	content string
+	target  string
+}
+
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		content := e.content
+		if e.target != "" {
+			hdr.SetMode(os.ModeSymlink | 0o777)
+			content = e.target
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, path string, entries []archiveEntry) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		switch {
+		case e.target != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.target
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		wantErr bool
+	}{
+		{"migrations", []archiveEntry{{name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}}, false},
+		{"nested", []archiveEntry{{name: "sql/"}, {name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}, {name: "sql/notes.txt", content: "notes"}}, false},
+		{"no migrations", []archiveEntry{{name: "notes.txt", content: "notes"}}, true},
+		{"parent", []archiveEntry{{name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}, {name: "../2_evil.up.sql", content: "DROP TABLE a;"}}, true},
+		{"nested parent", []archiveEntry{{name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}, {name: "sql/../../2_evil.up.sql", content: "DROP TABLE a;"}}, true},
+		{"absolute", []archiveEntry{{name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}, {name: "/2_evil.up.sql", content: "DROP TABLE a;"}}, true},
+		{"symlink", []archiveEntry{{name: "1_init.up.sql", content: "CREATE TABLE a (id INT);"}, {name: "2_evil.up.sql", target: "../2_evil.up.sql"}}, true},
+	}
+
+	for _, format := range []struct {
+		suffix string
+		write  func(*testing.T, string, []archiveEntry)
+	}{
+		{".zip", writeZip},
+		{".tar.gz", writeTarGz},
+	} {
+		for _, tt := range tests {
+			t.Run(tt.name+format.suffix, func(t *testing.T) {
+				// NOTE: the extraction directory is created in TMPDIR, the
+				// escaping entries would be written next to it.
+				tmp := t.TempDir()
+				t.Setenv("TMPDIR", tmp)
+
+				path := filepath.Join(t.TempDir(), "migrations"+format.suffix)
+				format.write(t, path, tt.entries)
+
+				dir, err := extractArchive(path)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("extractArchive() = %v, want error %v", err, tt.wantErr)
+				}
+				if err != nil {
+					entries, err := os.ReadDir(tmp)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(entries) != 0 {
+						t.Errorf("left %v in %s, want nothing", entries, tmp)
+					}
+					if _, err := os.Stat("/2_evil.up.sql"); err == nil {
+						t.Error("extracted /2_evil.up.sql")
+					}
+					return
+				}
+
+				content, err := os.ReadFile(filepath.Join(dir, "1_init.up.sql"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != "CREATE TABLE a (id INT);" {
+					t.Errorf("1_init.up.sql = %q", content)
+				}
+			})
+		}
+	}
+}
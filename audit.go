@@ -0,0 +1,100 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const (
+	outcomeApplied  = "applied"
+	outcomeNoChange = "no-change"
+	outcomeFailed   = "failed"
+)
+
+// runRecord is a line of the MIGRATION_LOG_FILE audit trail, and the body of
+// the notifications posted to the webhooks.
+type runRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Database    string    `json:"database,omitempty"`
+	FromVersion *uint     `json:"fromVersion"`
+	ToVersion   *uint     `json:"toVersion"`
+	Applied     int       `json:"applied"`
+	Dirty       bool      `json:"dirty"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// currentVersion returns the version of the database, nil if no migration
+// has been applied yet.
+func currentVersion(m *migrate.Migrate) (*uint, bool, error) {
+	return versionOrNil(m.Version())
+}
+
+// versionOrNil returns the version read by a Version method, nil if no
+// migration has been applied yet.
+func versionOrNil(vers uint, dirty bool, err error) (*uint, bool, error) {
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &vers, dirty, nil
+}
+
+// newRunRecord describes the outcome of the run that started at version
+// from, with the given pending versions.
+func (t *target) newRunRecord(from *uint, pending []uint, runErr error) (runRecord, error) {
+	rec := runRecord{
+		Timestamp:   now().UTC(),
+		Database:    t.name,
+		FromVersion: from,
+		Outcome:     runOutcome(runErr),
+	}
+	if rec.Outcome == outcomeFailed {
+		rec.Error = scrub(runErr.Error(), t.cfg.passwords())
+	}
+
+	to, dirty, err := currentVersion(t.m)
+	if err != nil {
+		return rec, fmt.Errorf("failed to get version: %w", err)
+	}
+	rec.ToVersion = to
+	rec.Dirty = dirty
+	if to != nil {
+		rec.Applied = len(appliedVersions(pending, *to, dirty))
+	}
+
+	return rec, nil
+}
+
+// runOutcome returns the outcome of a run that returned runErr.
+func runOutcome(runErr error) string {
+	switch {
+	case errors.Is(runErr, migrate.ErrNoChange):
+		return outcomeNoChange
+	case runErr != nil:
+		return outcomeFailed
+	}
+	return outcomeApplied
+}
+
+// logRun appends the record of a run to the MIGRATION_LOG_FILE.
+func (t *target) logRun(rec runRecord) error {
+	f, err := os.OpenFile(t.cfg.migrationLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open migration log: %w", err)
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(rec); err != nil {
+		return fmt.Errorf("failed to write migration log: %w", err)
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,110 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const dbAuthIAM = "iam"
+
+var defaultTokenTTL = 10 * time.Minute
+
+// tokenSource fetches the short-lived password of the database by running
+// the DB_AUTH_CMD, reusing it for DB_AUTH_TOKEN_TTL so that it is refreshed
+// before expiring.
+type tokenSource struct {
+	cmd []string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+}
+
+func (s *tokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && since(s.fetched) < s.ttl {
+		return s.token, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.cmd[0], s.cmd[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to fetch the database token: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", fmt.Errorf("failed to fetch the database token: empty output")
+	}
+
+	tokens.add(token)
+	s.token = token
+	s.fetched = now()
+	return token, nil
+}
+
+// ddl returns the config the migrations are applied with, connecting as the
+// DDL_DB_USER, when set, in place of the regular user.
+func (c Config) ddl() Config {
+	if c.ddlUser == "" {
+		return c
+	}
+
+	c.dbUser, c.dbPass = c.ddlUser, c.ddlPass
+	c.tokens = nil
+	if c.urlConfig != nil {
+		c.urlConfig = c.urlConfig.Clone()
+		c.urlConfig.User, c.urlConfig.Passwd = c.ddlUser, c.ddlPass
+
+		// NOTE: the DSN is parsed again to keep the x- parameters, read
+		// by openDriver. The credentials are escaped like the migrate
+		// driver expects them.
+		scheme, dsn, _ := strings.Cut(c.dbURL, "://")
+		if mc, err := mysql.ParseDSN(dsn); err == nil {
+			mc.User, mc.Passwd = url.QueryEscape(c.ddlUser), url.QueryEscape(c.ddlPass)
+			c.dbURL = scheme + "://" + mc.FormatDSN()
+		}
+	}
+	return c
+}
+
+// openDB opens the pool of connections to the database.
+func (c Config) openDB() (*sql.DB, error) {
+	connector, err := c.connector(c.mysqlConfig())
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(c.maxOpenConns)
+	return db, nil
+}
+
+// connector returns the connector opening connections with mc, fetching the
+// password for each new connection when DB_AUTH=iam.
+func (c Config) connector(mc *mysql.Config) (driver.Connector, error) {
+	if c.tokens != nil {
+		err := mc.Apply(mysql.BeforeConnect(func(_ context.Context, mc *mysql.Config) (err error) {
+			mc.Passwd, err = c.tokens.Token()
+			return
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mysql.NewConnector(mc)
+}
@@ -0,0 +1,43 @@
+package migrator
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// now, sleep and randInt63n are where the time is read from, waited on and
+// where the randomness comes from, replaced to make the behaviours depending
+// on them, like the migration window and the retries, deterministic.
+var (
+	now        = time.Now
+	sleep      = sleepContext
+	randInt63n = rand.Int63n
+)
+
+// sleepContext waits for d, returning early with the error of ctx once done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// since returns the time elapsed since t, according to now.
+func since(t time.Time) time.Duration {
+	return now().Sub(t)
+}
+
+// withJitter returns d extended by a random duration of up to half of it, so
+// that replicas retrying together spread their attempts.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d + time.Duration(randInt63n(int64(d/2)))
+}
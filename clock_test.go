@@ -0,0 +1,72 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubNow makes now return at, restoring it once t is done.
+func stubNow(t *testing.T, at time.Time) {
+	t.Helper()
+
+	prev := now
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = prev })
+}
+
+func TestWithJitter(t *testing.T) {
+	prev := randInt63n
+	t.Cleanup(func() { randInt63n = prev })
+
+	tests := []struct {
+		name   string
+		d      time.Duration
+		random func(int64) int64
+		want   time.Duration
+	}{
+		{"none", time.Second, func(int64) int64 { return 0 }, time.Second},
+		{"half", time.Second, func(n int64) int64 { return n - 1 }, time.Second + 500*time.Millisecond - 1},
+		{"zero", 0, nil, 0},
+		{"nanosecond", 1, nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			randInt63n = func(n int64) int64 {
+				if tt.random == nil {
+					t.Fatalf("randInt63n(%d) called", n)
+				}
+				if n != int64(tt.d/2) {
+					t.Errorf("randInt63n(%d), want %d", n, tt.d/2)
+				}
+				return tt.random(n)
+			}
+			if got := withJitter(tt.d); got != tt.want {
+				t.Errorf("withJitter(%s) = %s, want %s", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleepContext() = %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepContext() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSince(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stubNow(t, at)
+
+	if got := since(at.Add(-time.Minute)); got != time.Minute {
+		t.Errorf("since() = %s, want %s", got, time.Minute)
+	}
+}
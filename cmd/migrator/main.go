@@ -0,0 +1,13 @@
+// Command migrator renders the SQL templates and applies the migrations of the
+// configured databases, then serves their version over HTTP.
+package main
+
+import (
+	"os"
+
+	"github.com/leophys/migrator"
+)
+
+func main() {
+	os.Exit(migrator.Main(os.Args[1:]))
+}
@@ -0,0 +1,224 @@
+package migrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// fileValues holds the settings read from CONFIG_FILE, keyed by the name of
+// the environment variable they stand for.
+var fileValues = map[string]string{}
+
+// fileDatabases holds the entries of the DATABASES list in CONFIG_FILE, each
+// overriding the settings for a single database to be migrated.
+var fileDatabases []map[string]string
+
+// overrides holds the settings of the DATABASES entry being read, if any.
+var overrides map[string]string
+
+const defaultEnvFile = ".env"
+
+var envLine = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+
+var interpolation = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// getenv returns the value of the environment variable named by key, falling
+// back to the value set in the config file, if any. The settings of the
+// database being read take precedence over both.
+func getenv(key string) string {
+	if value, ok := overrides[key]; ok {
+		return value
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fileValues[key]
+}
+
+// loadConfigFile reads a JSON object mapping environment variable names to
+// their values. String values can reference the environment with ${VAR}, or
+// ${VAR:-default} to fall back to a default when VAR is unset or empty.
+//
+// The PROFILES object can define named sets of values, the one selected by
+// the PROFILE variable taking precedence over the other values of the file.
+func loadConfigFile(path string) error {
+	path, err := interpolate(path)
+	if err != nil {
+		return fmt.Errorf("invalid CONFIG_FILE path: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	var raw map[string]any
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+
+	var databases []map[string]string
+	if list, ok := raw["DATABASES"]; ok {
+		delete(raw, "DATABASES")
+
+		entries, ok := list.([]any)
+		if !ok {
+			return fmt.Errorf("DATABASES must be a list in config file")
+		}
+		for i, entry := range entries {
+			entryValues, ok := entry.(map[string]any)
+			if !ok {
+				return fmt.Errorf("DATABASES entry #%d must be an object in config file", i)
+			}
+			values, err := flattenValues(entryValues)
+			if err != nil {
+				return fmt.Errorf("invalid DATABASES entry #%d: %w", i, err)
+			}
+			databases = append(databases, values)
+		}
+	}
+
+	var profiles map[string]any
+	if list, ok := raw["PROFILES"]; ok {
+		delete(raw, "PROFILES")
+
+		if profiles, ok = list.(map[string]any); !ok {
+			return fmt.Errorf("PROFILES must be an object in config file")
+		}
+	}
+
+	values, err := flattenValues(raw)
+	if err != nil {
+		return err
+	}
+
+	profile, ok := os.LookupEnv("PROFILE")
+	if !ok {
+		profile = values["PROFILE"]
+	}
+	if profile != "" {
+		profileValues, ok := profiles[profile].(map[string]any)
+		if !ok {
+			return fmt.Errorf("profile %q is not defined as an object in PROFILES", profile)
+		}
+		selected, err := flattenValues(profileValues)
+		if err != nil {
+			return fmt.Errorf("invalid profile %q: %w", profile, err)
+		}
+		for key, value := range selected {
+			values[key] = value
+		}
+	}
+
+	fileValues = values
+	fileDatabases = databases
+	return nil
+}
+
+// flattenValues converts the scalar values of a config file object to the
+// strings they would be set to in the environment.
+func flattenValues(raw map[string]any) (map[string]string, error) {
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			expanded, err := interpolate(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s in config file: %w", key, err)
+			}
+			values[key] = expanded
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			// NOTE: most flags are enabled by being set at all, so false
+			// leaves them unset.
+			if v {
+				values[key] = "true"
+			}
+		default:
+			return nil, fmt.Errorf("unsupported value for %s in config file", key)
+		}
+	}
+
+	return values, nil
+}
+
+func interpolate(s string) (string, error) {
+	var undefined []string
+	expanded := interpolation.ReplaceAllStringFunc(s, func(ref string) string {
+		match := interpolation.FindStringSubmatch(ref)
+		name, hasDefault, defaultValue := match[1], match[2] != "", match[3]
+
+		value, ok := os.LookupEnv(name)
+		switch {
+		case value != "":
+			return value
+		case hasDefault:
+			return defaultValue
+		case ok:
+			return ""
+		}
+		undefined = append(undefined, name)
+		return ref
+	})
+
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variables: %s", strings.Join(undefined, ", "))
+	}
+
+	return expanded, nil
+}
+
+// loadEnvFile sets the variables defined in the ENV_FILE, or in the .env file
+// of the working directory if present, that are not set in the environment
+// already. Lines are in the form KEY=value, optionally prefixed by export and
+// with the value quoted, comments start with #.
+func loadEnvFile() error {
+	path := os.Getenv("ENV_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = defaultEnvFile
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open env file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		match := envLine.FindStringSubmatch(line)
+		if match == nil {
+			return fmt.Errorf("invalid line %d in env file %q", n, path)
+		}
+		key, value := match[1], strings.TrimSpace(match[2])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,213 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+const (
+	dbDriverMySQL   = "mysql"
+	dbDriverMariaDB = "mariadb"
+)
+
+const maxIdentifierLength = 64
+
+// defaultMigrationsTable is the table the migrate driver tracks the version
+// in, prefixed with MIGRATIONS_TABLE_PREFIX when set.
+const defaultMigrationsTable = "schema_migrations"
+
+var safeIdentifier = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// secretParam matches the names of the DSN parameters whose value is
+// redacted when logged.
+var secretParam = regexp.MustCompile(`(?i)pass|secret|token|key`)
+
+// validateIdentifier checks that name can be safely interpolated in SQL
+// statements and DSNs where placeholders cannot be used, allowing only
+// letters, digits and underscores up to the MySQL identifier length limit.
+func validateIdentifier(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty identifier")
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("identifier %q longer than %d characters", name, maxIdentifierLength)
+	}
+	if !safeIdentifier.MatchString(name) {
+		return fmt.Errorf("unsafe identifier %q: only letters, digits and underscores are allowed", name)
+	}
+	return nil
+}
+
+// quoteIdentifier validates name and quotes it for use in SQL statements.
+func quoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name); err != nil {
+		return "", err
+	}
+	return "`" + name + "`", nil
+}
+
+func (c Config) mysqlConfig() *mysql.Config {
+	var mc *mysql.Config
+	if c.urlConfig != nil {
+		mc = c.urlConfig.Clone()
+	} else {
+		mc = mysql.NewConfig()
+		mc.User = c.dbUser
+		mc.Passwd = c.dbPass
+		mc.Net = "tcp"
+		mc.Addr = net.JoinHostPort(c.dbHost, strconv.Itoa(int(c.dbPort)))
+		mc.DBName = c.dbName
+		mc.ConnectionAttributes = "program_name:" + c.appName
+	}
+	// NOTE: needed to scan the timestamps of the history table.
+	mc.ParseTime = true
+	if c.tokens != nil {
+		// NOTE: IAM tokens are sent with the cleartext plugin, TLS should
+		// be enabled with DB_URL_TEMPLATE.
+		mc.AllowCleartextPasswords = true
+	}
+	return mc
+}
+
+// logDSN logs, at debug level, the connection settings in effect, with the
+// password and the secret parameters redacted.
+func (c Config) logDSN() {
+	scheme, dsn, _ := strings.Cut(c.url(), "://")
+	mc, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		slog.Debug("Failed to parse the DSN", "target", c.name, "err", err)
+		return
+	}
+
+	password := ""
+	if mc.Passwd != "" {
+		password = "***"
+	}
+	host, port, _ := net.SplitHostPort(mc.Addr)
+
+	// NOTE: the parameters are read back from the formatted DSN, which
+	// includes the ones parsed into fields, like tls and multiStatements.
+	mc.Passwd = ""
+	_, query, _ := strings.Cut(mc.FormatDSN(), "?")
+	values, _ := url.ParseQuery(query)
+	params := map[string]string{}
+	for name := range values {
+		params[name] = values.Get(name)
+		if secretParam.MatchString(name) {
+			params[name] = "***"
+		}
+	}
+	// NOTE: not included by FormatDSN.
+	if mc.ConnectionAttributes != "" {
+		params["connectionAttributes"] = mc.ConnectionAttributes
+	}
+
+	slog.Debug("Effective DSN",
+		"target", c.name,
+		"scheme", scheme,
+		"user", mc.User,
+		"password", password,
+		"net", mc.Net,
+		"host", host,
+		"port", port,
+		"db", mc.DBName,
+		"params", params,
+	)
+}
+
+// createDatabase connects to the server without selecting any database and
+// creates the configured one, if it does not exist yet.
+func createDatabase(ctx context.Context, c Config) error {
+	mc := c.mysqlConfig()
+	mc.DBName = ""
+
+	name, err := quoteIdentifier(c.dbName)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: identifiers cannot be passed as placeholders.
+	stmt := "CREATE DATABASE IF NOT EXISTS " + name
+	if c.dbCharset != "" {
+		if err := validateIdentifier(c.dbCharset); err != nil {
+			return err
+		}
+		stmt += " CHARACTER SET " + c.dbCharset
+	}
+	if c.dbCollation != "" {
+		if err := validateIdentifier(c.dbCollation); err != nil {
+			return err
+		}
+		stmt += " COLLATE " + c.dbCollation
+	}
+
+	connector, err := c.connector(mc)
+	if err != nil {
+		return fmt.Errorf("failed to open connection: %w", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("failed to create database %q: %w", c.dbName, err)
+	}
+
+	return nil
+}
+
+// renderURL renders the given template against the environment, returning
+// the resulting database URL and its parsed connection settings.
+func renderURL(text string) (string, *mysql.Config, error) {
+	tmpl, err := template.New("DB_URL_TEMPLATE").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, envToMap()); err != nil {
+		return "", nil, fmt.Errorf("failed to execute template: %w", err)
+	}
+	dbURL := strings.TrimSpace(b.String())
+
+	// NOTE: MySQL DSNs are not valid URLs, so the scheme is split by hand.
+	scheme, dsn, ok := strings.Cut(dbURL, "://")
+	if !ok {
+		return "", nil, fmt.Errorf("rendered URL has no scheme")
+	}
+	if !slices.Contains(database.List(), scheme) {
+		return "", nil, fmt.Errorf("unsupported scheme %q, available drivers: %s", scheme, strings.Join(database.List(), ", "))
+	}
+
+	mc, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid rendered URL: %w", err)
+	}
+
+	// NOTE: the same handling of the migrate driver, which unescapes the
+	// credentials and consumes the x- parameters.
+	if mc.User, err = url.QueryUnescape(mc.User); err != nil {
+		return "", nil, fmt.Errorf("invalid user in rendered URL: %w", err)
+	}
+	if mc.Passwd, err = url.QueryUnescape(mc.Passwd); err != nil {
+		return "", nil, fmt.Errorf("invalid password in rendered URL: %w", err)
+	}
+	for k := range mc.Params {
+		if strings.HasPrefix(k, "x-") {
+			delete(mc.Params, k)
+		}
+	}
+
+	return dbURL, mc, nil
+}
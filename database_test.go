@@ -0,0 +1,59 @@
+package migrator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		ident   string
+		wantErr bool
+	}{
+		{"simple", "users", false},
+		{"underscores and digits", "app_2024_v1", false},
+		{"uppercase", "Schema_Migrations", false},
+		{"max length", strings.Repeat("a", maxIdentifierLength), false},
+		{"empty", "", true},
+		{"too long", strings.Repeat("a", maxIdentifierLength+1), true},
+		{"backtick", "users`; DROP TABLE users; --", true},
+		{"lone backtick", "`", true},
+		{"nul", "users\x00", true},
+		{"trailing space", "users ", true},
+		{"leading space", " users", true},
+		{"dash", "my-app", true},
+		{"dot", "app.users", true},
+		{"quote", "users'", true},
+		{"unicode letter", "caf\u00e9", true},
+		{"unicode lookalike", "us\u0435rs", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateIdentifier(tt.ident)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateIdentifier(%q) = %v, want error: %t", tt.ident, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		ident   string
+		want    string
+		wantErr bool
+	}{
+		{"users", "`users`", false},
+		{"schema_migrations", "`schema_migrations`", false},
+		{"a`b", "", true},
+		{"``", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := quoteIdentifier(tt.ident)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("quoteIdentifier(%q) = %q, %v, want %q, error: %t", tt.ident, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
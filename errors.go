@@ -0,0 +1,129 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrMissingConfig is matched by a ConfigError for a required setting
+	// that is not set.
+	ErrMissingConfig = errors.New("missing config")
+	// ErrInvalidConfig is matched by a ConfigError for a setting that cannot
+	// be parsed or is not allowed.
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrTemplateParse is matched by a TemplateError for templates that
+	// cannot be read or parsed.
+	ErrTemplateParse = errors.New("failed to read templates")
+	// ErrTemplateExecute is matched by a TemplateError for templates that
+	// cannot be executed or whose output cannot be written.
+	ErrTemplateExecute = errors.New("failed to execute template")
+
+	// ErrMigrationsNotFound is returned when the migrations path does not
+	// exist.
+	ErrMigrationsNotFound = errors.New("migrations path does not exist")
+	// ErrNoMigrations is returned when the migrations path contains no
+	// migration files.
+	ErrNoMigrations = errors.New("migrations path contains no migration files")
+)
+
+// ConfigError reports a problem with the setting named Var. Err is nil when
+// the setting is missing.
+type ConfigError struct {
+	Var string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Missing %s", e.Var)
+	}
+	return fmt.Sprintf("Invalid %s: %v", e.Var, e.Err)
+}
+
+func (e *ConfigError) Is(target error) bool {
+	if e.Err == nil {
+		return target == ErrMissingConfig
+	}
+	return target == ErrInvalidConfig
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateError reports a failure to parse or execute the template named
+// Name, which is empty when the templates could not be parsed at all. Kind is
+// either ErrTemplateParse or ErrTemplateExecute.
+type TemplateError struct {
+	Name string
+	Kind error
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%v %q: %v", e.Kind, e.Name, e.Err)
+}
+
+func (e *TemplateError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// Stages of the run reported by an ExitError.
+const (
+	stageConfig         = "config"
+	stageFetch          = "fetch"
+	stageConnect        = "connect"
+	stageRender         = "render"
+	stageValidate       = "validate"
+	stageWindow         = "window"
+	stageCreateDatabase = "create-database"
+	stageInstantiate    = "instantiate"
+	stageBaseline       = "baseline"
+	stagePlan           = "plan"
+	stageCheck          = "check"
+	stageVerify         = "verify"
+	stageExec           = "exec"
+	stageMigrate        = "migrate"
+	stageVersion        = "version"
+)
+
+// ExitError reports a failure of Run at the given Stage, with the exit code
+// of the migrator command.
+type ExitError struct {
+	Stage string
+	Code  int
+	Err   error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: %v (exit code %d)", e.Stage, e.Err, e.Code)
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// write writes the error as JSON to the file at path, for the ERROR_FILE,
+// with the given passwords masked.
+func (e *ExitError) write(path string, passwords []string) error {
+	content, err := json.Marshal(map[string]any{
+		"stage":    e.Stage,
+		"error":    scrub(e.Err.Error(), passwords),
+		"exitCode": e.Code,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0o644)
+}
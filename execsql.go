@@ -0,0 +1,121 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// execSQLFile runs the statements of the EXEC_SQL_FILE against the database,
+// in order, connecting as the DDL_DB_USER when set. The file is not recorded
+// as a migration, and the version is left untouched. A failure is returned as
+// an *ExitError.
+func (t *target) execSQLFile(ctx context.Context) error {
+	content, err := os.ReadFile(t.cfg.execSQLFile)
+	if err != nil {
+		slog.Error("Failed to read the SQL file", "file", t.cfg.execSQLFile, "err", err)
+		return &ExitError{Stage: stageExec, Code: 1, Err: err}
+	}
+
+	db, err := t.cfg.ddl().openDB()
+	if err != nil {
+		slog.Error("Failed to open database connection", "err", err)
+		return &ExitError{Stage: stageExec, Code: 2, Err: err}
+	}
+	defer db.Close()
+
+	// NOTE: the statements are run on a single connection, so that session
+	// settings, e.g. SET foreign_key_checks = 0, apply to the following ones.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		slog.Error("Failed to connect to the database", "err", err)
+		return &ExitError{Stage: stageExec, Code: 2, Err: err}
+	}
+	defer conn.Close()
+
+	statements := splitStatements(string(content))
+	slog.Warn("Executing SQL file outside of the migrations", "file", t.cfg.execSQLFile, "statements", len(statements))
+	for i, stmt := range statements {
+		slog.Info("Executing statement", "file", t.cfg.execSQLFile, "index", i+1, "statement", stmt)
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			slog.Error("Failed to execute statement", "file", t.cfg.execSQLFile, "index", i+1, "err", err)
+			return &ExitError{Stage: stageExec, Code: 3, Err: fmt.Errorf("statement %d: %w", i+1, err)}
+		}
+	}
+
+	slog.Info("SQL file executed", "file", t.cfg.execSQLFile, "statements", len(statements))
+	return nil
+}
+
+// splitStatements splits sql into its statements, on the semicolons outside
+// of quotes and comments. Statements made only of comments are dropped, but
+// for the versioned comments, like /*!40101 SET NAMES utf8 */, which MySQL
+// runs.
+//
+// DELIMITER is a client command, and is not supported.
+func splitStatements(sql string) []string {
+	var statements []string
+	var b strings.Builder
+	code := false
+	flush := func() {
+		if code {
+			statements = append(statements, strings.TrimSpace(b.String()))
+		}
+		b.Reset()
+		code = false
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(sql) && sql[end] != c {
+				if sql[end] == '\\' && c != '`' {
+					end++
+				}
+				end++
+			}
+			end = min(end, len(sql)-1)
+			b.WriteString(sql[i : end+1])
+			i = end
+			code = true
+		case c == '#' || isDashComment(sql[i:]):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			b.WriteString(sql[i : i+end])
+			i += end - 1
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i - 4
+			}
+			b.WriteString(sql[i : i+end+4])
+			code = code || strings.HasPrefix(sql[i:], "/*!")
+			i += end + 3
+		case c == ';':
+			flush()
+		default:
+			b.WriteByte(c)
+			code = code || !unicode.IsSpace(rune(c))
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// isDashComment reports whether sql starts with a -- comment, which MySQL
+// requires to be followed by a whitespace or a control character, or to end
+// the input.
+func isDashComment(sql string) bool {
+	if !strings.HasPrefix(sql, "--") {
+		return false
+	}
+	return len(sql) == 2 || sql[2] <= ' '
+}
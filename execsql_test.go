@@ -0,0 +1,44 @@
+package migrator
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"single", "SELECT 1", []string{"SELECT 1"}},
+		{"trailing semicolon", "SELECT 1;\n", []string{"SELECT 1"}},
+		{"several", "SELECT 1;\nSELECT 2;\n\n;SELECT 3", []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{"single quotes", "INSERT INTO a VALUES ('a;b');SELECT 1", []string{"INSERT INTO a VALUES ('a;b')", "SELECT 1"}},
+		{"double quotes", `INSERT INTO a VALUES ("a;b");SELECT 1`, []string{`INSERT INTO a VALUES ("a;b")`, "SELECT 1"}},
+		{"backticks", "SELECT `a;b` FROM a;SELECT 1", []string{"SELECT `a;b` FROM a", "SELECT 1"}},
+		{"doubled quotes", "INSERT INTO a VALUES ('it''s; fine');SELECT 1", []string{"INSERT INTO a VALUES ('it''s; fine')", "SELECT 1"}},
+		{"escaped quotes", `INSERT INTO a VALUES ('it\'s; fine');SELECT 1`, []string{`INSERT INTO a VALUES ('it\'s; fine')`, "SELECT 1"}},
+		{"backslash in backticks", "SELECT `a\\`;SELECT 1", []string{"SELECT `a\\`", "SELECT 1"}},
+		{"unterminated quote", "SELECT 'a;b", []string{"SELECT 'a;b"}},
+		{"dash comment", "SELECT 1; -- a; b\nSELECT 2", []string{"SELECT 1", "-- a; b\nSELECT 2"}},
+		{"dash comment before newline", "SELECT 1;\n--\nSELECT 2;\n--", []string{"SELECT 1", "--\nSELECT 2"}},
+		{"dash comment before tab", "SELECT 1;--\ta; b\n", []string{"SELECT 1"}},
+		{"double minus", "SELECT 1--1;SELECT 2", []string{"SELECT 1--1", "SELECT 2"}},
+		{"hash comment", "SELECT 1; # a; b\nSELECT 2", []string{"SELECT 1", "# a; b\nSELECT 2"}},
+		{"block comment", "SELECT /* a; b */ 1;SELECT 2", []string{"SELECT /* a; b */ 1", "SELECT 2"}},
+		{"unterminated block comment", "SELECT 1;/* a; b", []string{"SELECT 1"}},
+		{"only comments", "-- a\n# b\n/* c */;SELECT 1", []string{"SELECT 1"}},
+		{"versioned comment", "/*!40101 SET NAMES utf8 */;SELECT 1", []string{"/*!40101 SET NAMES utf8 */", "SELECT 1"}},
+		{"quotes in comments", "-- it's\nSELECT 1;/* \" */SELECT 2", []string{"-- it's\nSELECT 1", "/* \" */SELECT 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.sql); !slices.Equal(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
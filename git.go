@@ -0,0 +1,171 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const gitSchemePrefix = "git+"
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func isGitSource(migrations string) bool {
+	return strings.HasPrefix(migrations, gitSchemePrefix)
+}
+
+// fetchGitMigrations shallow clones the repository described by rawURL (in
+// the form git+https://host/repo.git#ref) into cacheDir and returns a copy of
+// subpath inside the clone, in a new temporary directory, so that the
+// templates rendered along with the migrations do not end up in the clone.
+// Clones are cached by commit, so that restarts pointing at the same commit
+// do not hit the network again but to resolve the ref.
+func fetchGitMigrations(rawURL, subpath, cacheDir string) (string, error) {
+	repo, ref, _ := strings.Cut(strings.TrimPrefix(rawURL, gitSchemePrefix), "#")
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	commit, err := resolveGitRef(repo, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create git cache directory: %w", err)
+	}
+
+	dir := filepath.Join(cacheDir, commit)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := cloneGitCommit(repo, ref, commit, cacheDir, dir); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to inspect git cache: %w", err)
+	} else {
+		slog.Info("Reusing cached git checkout", "repo", repo, "ref", ref, "commit", commit)
+	}
+
+	path := filepath.Join(dir, subpath)
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("subpath %q does not exist at %s@%s", subpath, repo, ref)
+	}
+
+	tmp, err := os.MkdirTemp("", "migrator-git-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create migrations directory: %w", err)
+	}
+	if err := copyDir(path, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to copy the migrations out of the git cache: %w", err)
+	}
+
+	return tmp, nil
+}
+
+// copyDir copies the directories and regular files in src into dst, which
+// must exist. Links are refused, as they could point outside of src.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		// NOTE: the repository itself is not needed to apply the migrations.
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		target := filepath.Join(dst, rel)
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case entry.Type().IsRegular():
+			return copyFile(path, target)
+		default:
+			return fmt.Errorf("%q is not a regular file or directory", rel)
+		}
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func resolveGitRef(repo, ref string) (string, error) {
+	if commitHash.MatchString(ref) {
+		return ref, nil
+	}
+
+	out, err := git("ls-remote", repo, ref)
+	if err != nil {
+		return "", err
+	}
+
+	commit, _, _ := strings.Cut(out, "\t")
+	if !commitHash.MatchString(commit) {
+		return "", fmt.Errorf("ref %q does not exist in %s", ref, repo)
+	}
+
+	return commit, nil
+}
+
+func cloneGitCommit(repo, ref, commit, cacheDir, dst string) error {
+	tmp, err := os.MkdirTemp(cacheDir, ".clone-")
+	if err != nil {
+		return fmt.Errorf("failed to create clone directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	slog.Info("Cloning migrations", "repo", repo, "ref", ref, "commit", commit)
+
+	for _, args := range [][]string{
+		{"init", "--quiet", tmp},
+		{"-C", tmp, "fetch", "--quiet", "--depth", "1", repo, ref},
+		{"-C", tmp, "checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		if _, err := git(args...); err != nil {
+			return err
+		}
+	}
+
+	// NOTE: renaming makes the clone visible in the cache only once complete.
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("failed to store clone in cache: %w", err)
+	}
+
+	return nil
+}
+
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
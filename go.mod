@@ -3,8 +3,13 @@ module github.com/leophys/migrator
 go 1.22.6
 
 require (
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
-	github.com/golang-migrate/migrate/v4 v4.17.1 // indirect
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/golang-migrate/migrate/v4 v4.17.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
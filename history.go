@@ -0,0 +1,162 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+type historyEntry struct {
+	Version   uint      `json:"version"`
+	AppliedBy string    `json:"appliedBy"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// appliedBy identifies who applied the migrations, for the history table.
+func (c Config) appliedBy() string {
+	if c.deployID == "" {
+		return c.appName
+	}
+	return c.appName + "/" + c.deployID
+}
+
+// recordHistory writes to the history table the versions, among the pending
+// ones, that have been applied by the last run.
+func (t *target) recordHistory(pending []uint) error {
+	current, dirty, err := t.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get version: %w", err)
+	}
+
+	applied := appliedVersions(pending, current, dirty)
+	if len(applied) == 0 {
+		return nil
+	}
+
+	table, err := quoteIdentifier(t.cfg.historyTable)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: recorded as part of the migration, with the DDL_DB_USER if set.
+	db := t.db
+	if t.cfg.ddlUser != "" {
+		if db, err = t.cfg.ddl().openDB(); err != nil {
+			return fmt.Errorf("failed to open connection: %w", err)
+		}
+		defer db.Close()
+	}
+
+	if _, err := db.Exec(fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s ("+
+			"version BIGINT NOT NULL, "+
+			"applied_by VARCHAR(255) NOT NULL, "+
+			"applied_at TIMESTAMP NOT NULL)",
+		table,
+	)); err != nil {
+		return fmt.Errorf("failed to create history table: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	appliedBy := t.cfg.appliedBy()
+	appliedAt := now().UTC()
+	for _, v := range applied {
+		if _, err := tx.Exec(
+			fmt.Sprintf("INSERT INTO %s (version, applied_by, applied_at) VALUES (?, ?, ?)", table),
+			v, appliedBy, appliedAt,
+		); err != nil {
+			return fmt.Errorf("failed to record version %d: %w", v, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// appliedVersions returns the versions, among the pending ones, that have
+// been applied once the database is at the given version.
+func appliedVersions(pending []uint, current uint, dirty bool) []uint {
+	var applied []uint
+	for _, v := range pending {
+		if v < current || (v == current && !dirty) {
+			applied = append(applied, v)
+		}
+	}
+	return applied
+}
+
+func (t *target) history() ([]historyEntry, error) {
+	table, err := quoteIdentifier(t.cfg.historyTable)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.db.Query(fmt.Sprintf(
+		"SELECT version, applied_by, applied_at FROM %s ORDER BY applied_at, version",
+		table,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []historyEntry{}
+	for rows.Next() {
+		var e historyEntry
+		if err := rows.Scan(&e.Version, &e.AppliedBy, &e.AppliedAt); err != nil {
+			return nil, fmt.Errorf("failed to read history: %w", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// history reports the versions recorded in the history table, keyed by
+// database name when more than one is configured.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]any, len(s.targets))
+	for _, t := range s.targets {
+		if t.cfg.historyTable == "" {
+			http.Error(w, "History not enabled", http.StatusNotFound)
+			return
+		}
+
+		entries, err := t.history()
+		if err != nil {
+			slog.Error("Failed to get history", "database", t.name, "err", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		if len(s.targets) == 1 && t.name == "" {
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(entries)
+			return
+		}
+		result[t.name] = entries
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,220 @@
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	migratemysql "github.com/golang-migrate/migrate/v4/database/mysql"
+)
+
+// lockWaitThreshold is how long acquiring the migration lock takes before it
+// is reported as a wait.
+var lockWaitThreshold = 1 * time.Second
+
+// lockTimeout is how long, in seconds, a LOCK_NAME lock is waited for, as
+// long as the migrate driver waits for its own.
+const lockTimeout = 10
+
+// validLockName matches the allowed LOCK_NAME values, hashed to the key of
+// the lock.
+var validLockName = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,255}$`)
+
+// newMigrate is migrate.New, with the database driver of c wrapped to log the
+// acquisition of the migration lock and, when set, to take lock in place of
+// the driver's own.
+func newMigrate(sourceURL string, c Config, lock *namedLock) (*migrate.Migrate, error) {
+	driver, err := c.openDriver(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(sourceURL, "mysql", driver)
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// openDriver opens the database driver of c, wrapped like newMigrate does.
+//
+// The driver is given a pool connecting with mysqlConfig, rather than a DSN,
+// which the migrate driver formats again without the connection attributes.
+// The x- parameters of DB_URL_TEMPLATE are read here in its place.
+func (c Config) openDriver(lock *namedLock) (database.Driver, error) {
+	mc := c.driverConfig()
+	connector, err := c.connector(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	noLock := lock != nil
+	if value := c.urlParam("x-no-lock"); value != "" && !noLock {
+		if noLock, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("could not parse x-no-lock as bool: %w", err)
+		}
+	}
+	var statementTimeout time.Duration
+	if value := c.urlParam("x-statement-timeout"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse x-statement-timeout as int: %w", err)
+		}
+		statementTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	db := sql.OpenDB(connector)
+	driver, err := migratemysql.WithInstance(db, &migratemysql.Config{
+		DatabaseName:     mc.DBName,
+		MigrationsTable:  c.versionTable(),
+		NoLock:           noLock,
+		StatementTimeout: statementTimeout,
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return lockLogger{Driver: driver, named: lock}, nil
+}
+
+// driverConfig returns the connection settings of the migrate driver, which
+// needs the statements of a migration to be sent at once.
+func (c Config) driverConfig() *mysql.Config {
+	mc := c.mysqlConfig()
+	mc.MultiStatements = true
+	return mc
+}
+
+// namedLock is the advisory lock named after LOCK_NAME, taken on a
+// connection of its own out of db.
+type namedLock struct {
+	db   *sql.DB
+	key  string
+	conn *sql.Conn
+}
+
+// newNamedLock returns the lock for name, hashed to a stable key within the
+// length MySQL allows for lock names.
+func newNamedLock(db *sql.DB, name string) *namedLock {
+	sum := sha256.Sum256([]byte(name))
+	return &namedLock{db: db, key: "migrator:" + hex.EncodeToString(sum[:16])}
+}
+
+// lock returns the LOCK_NAME lock of the target, nil when not set.
+func (t *target) lock() *namedLock {
+	if t.cfg.lockName == "" {
+		return nil
+	}
+	return newNamedLock(t.db, t.cfg.lockName)
+}
+
+func (l *namedLock) Lock() error {
+	if l.conn != nil {
+		return database.ErrLocked
+	}
+
+	ctx := context.Background()
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	var success bool
+	query := "SELECT GET_LOCK(?, ?)"
+	if err := conn.QueryRowContext(ctx, query, l.key, lockTimeout).Scan(&success); err != nil {
+		conn.Close()
+		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	}
+	if !success {
+		conn.Close()
+		return database.ErrLocked
+	}
+
+	l.conn = conn
+	return nil
+}
+
+func (l *namedLock) Unlock() error {
+	if l.conn == nil {
+		return database.ErrNotLocked
+	}
+	defer func() {
+		l.conn.Close()
+		l.conn = nil
+	}()
+
+	query := "SELECT RELEASE_LOCK(?)"
+	if _, err := l.conn.ExecContext(context.Background(), query, l.key); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// lockLogger logs structured events, tagged with event=migrate.lock.*, while
+// the driver, or the named lock when set, acquires and releases the
+// migration lock.
+type lockLogger struct {
+	database.Driver
+	named *namedLock
+}
+
+func (d lockLogger) lock() error {
+	if d.named != nil {
+		return d.named.Lock()
+	}
+	return d.Driver.Lock()
+}
+
+func (d lockLogger) unlock() error {
+	if d.named != nil {
+		return d.named.Unlock()
+	}
+	return d.Driver.Unlock()
+}
+
+func (d lockLogger) Lock() error {
+	start := now()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(lockWaitThreshold):
+			slog.Warn("Waiting for the migration lock", "event", "migrate.lock.wait")
+		}
+	}()
+
+	err := d.lock()
+	close(done)
+	waited := since(start)
+	if err != nil {
+		slog.Warn("Failed to acquire the migration lock", "event", "migrate.lock.error", "waited", waited, "err", err)
+		return err
+	}
+
+	if waited >= lockWaitThreshold {
+		slog.Info("Migration lock acquired", "event", "migrate.lock.acquired", "waited", waited)
+	} else {
+		slog.Debug("Migration lock acquired", "event", "migrate.lock.acquired", "waited", waited)
+	}
+	return nil
+}
+
+func (d lockLogger) Unlock() error {
+	err := d.unlock()
+	if err != nil {
+		slog.Warn("Failed to release the migration lock", "event", "migrate.lock.error", "err", err)
+		return err
+	}
+	slog.Debug("Migration lock released", "event", "migrate.lock.released")
+	return nil
+}
@@ -0,0 +1,95 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// handshakeServer accepts connections on a local port, greeting them like a
+// MySQL server, and sends the first handshake response received on the
+// returned channel before closing the connections.
+func handshakeServer(t *testing.T) (uint16, <-chan []byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// NOTE: the driver logs the connections closed after the handshake.
+	mysql.SetLogger(log.New(io.Discard, "", 0))
+	t.Cleanup(func() { mysql.SetLogger(log.New(os.Stderr, "[mysql] ", log.Ldate|log.Ltime|log.Lshortfile)) })
+
+	// NOTE: protocol 10 greeting, with the capabilities of protocol 4.1,
+	// secure connection, plugin auth and connection attributes.
+	var greeting bytes.Buffer
+	greeting.WriteByte(10)
+	greeting.WriteString("8.0.0\x00")
+	greeting.Write([]byte{1, 0, 0, 0})
+	greeting.WriteString("12345678\x00")
+	greeting.Write([]byte{0x00, 0x82, 0x21, 0x02, 0x00, 0x18, 0x00, 21})
+	greeting.Write(make([]byte, 10))
+	greeting.WriteString("123456789012\x00")
+	greeting.WriteString("mysql_native_password\x00")
+
+	responses := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			header := make([]byte, 4)
+			binary.LittleEndian.PutUint32(header, uint32(greeting.Len()))
+			header[3] = 0
+			conn.Write(append(header, greeting.Bytes()...))
+
+			if _, err := io.ReadFull(conn, header); err == nil {
+				payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+				if _, err := io.ReadFull(conn, payload); err == nil {
+					select {
+					case responses <- payload:
+					default:
+					}
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port), responses
+}
+
+func TestOpenDriverSendsConnectionAttributes(t *testing.T) {
+	port, responses := handshakeServer(t)
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"credentials", Config{dbUser: "app", dbPass: "secret", dbHost: "127.0.0.1", dbPort: port, dbName: "app", appName: "billing"}},
+		{"ddl user", Config{dbUser: "app", dbPass: "secret", ddlUser: "owner", ddlPass: "secret", dbHost: "127.0.0.1", dbPort: port, dbName: "app", appName: "billing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.ddl().openDriver(nil); err == nil {
+				t.Fatal("openDriver() succeeded against the handshake server")
+			}
+
+			response := <-responses
+			if !bytes.Contains(response, append([]byte{byte(len("program_name"))}, "program_name"...)) ||
+				!bytes.Contains(response, append([]byte{byte(len("billing"))}, "billing"...)) {
+				t.Errorf("handshake response %q does not carry program_name:billing", response)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const logFormatText = "text"
+
+// stdHandler is a slog.Handler writing the records in the format of the
+// default slog logger, i.e. the date and time as the log package formats
+// them, followed by the level, the message and the attributes as key=value
+// pairs.
+type stdHandler struct {
+	// attrs formats the attributes, along with the source, of a record.
+	attrs slog.Handler
+	out   *stdOutput
+}
+
+type stdOutput struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func newStdHandler(w io.Writer, opts *slog.HandlerOptions) *stdHandler {
+	out := &stdOutput{w: w}
+
+	attrOpts := *opts
+	attrOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return &stdHandler{attrs: slog.NewTextHandler(&out.buf, &attrOpts), out: out}
+}
+
+func (h *stdHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.attrs.Enabled(ctx, level)
+}
+
+func (h *stdHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	// NOTE: the text handler leaves out the time when zero, it is written
+	// in front instead.
+	at := r.Time
+	r.Time = time.Time{}
+	h.out.buf.Reset()
+	if err := h.attrs.Handle(ctx, r); err != nil {
+		return err
+	}
+
+	var line bytes.Buffer
+	if !at.IsZero() {
+		line.WriteString(at.Format("2006/01/02 15:04:05 "))
+	}
+	line.WriteString(r.Level.String())
+	line.WriteByte(' ')
+	line.WriteString(r.Message)
+	if attrs := bytes.TrimSpace(h.out.buf.Bytes()); len(attrs) > 0 {
+		line.WriteByte(' ')
+		line.Write(attrs)
+	}
+	line.WriteByte('\n')
+
+	_, err := h.out.w.Write(line.Bytes())
+	return err
+}
+
+func (h *stdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stdHandler{attrs: h.attrs.WithAttrs(attrs), out: h.out}
+}
+
+func (h *stdHandler) WithGroup(name string) slog.Handler {
+	return &stdHandler{attrs: h.attrs.WithGroup(name), out: h.out}
+}
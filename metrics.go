@@ -0,0 +1,89 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// metricFamily is a gauge of the Prometheus text exposition, with a sample
+// per database.
+type metricFamily struct {
+	name    string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	database string
+	value    float64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics serves the version of each database, whether it is dirty, the
+// highest version found in its migrations source and the number of pending
+// migrations, in the Prometheus text format.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	current := metricFamily{name: "migrator_current_version", help: "Version of the database schema, 0 when no migration is applied."}
+	dirty := metricFamily{name: "migrator_dirty", help: "Whether the database is dirty after a failed migration."}
+	available := metricFamily{name: "migrator_available_version", help: "Highest version of the migrations source."}
+	pending := metricFamily{name: "migrator_pending_migrations", help: "Number of migrations of the source not applied yet."}
+
+	for _, t := range s.targets {
+		version, isDirty, err := t.version()
+		noVersion := errors.Is(err, migrate.ErrNilVersion)
+		if err != nil && !noVersion {
+			slog.Error("Failed to get version", "database", t.name, "err", err)
+			continue
+		}
+		current.samples = append(current.samples, metricSample{t.name, float64(version)})
+		dirty.samples = append(dirty.samples, metricSample{t.name, boolGauge(isDirty)})
+
+		versions, err := availableVersions(t.cfg.migrationsPath())
+		if err != nil {
+			slog.Error("Failed to list the migrations", "database", t.name, "err", err)
+			continue
+		}
+		count := 0
+		for _, v := range versions {
+			if noVersion || v > version {
+				count++
+			}
+		}
+		var highest uint
+		if len(versions) > 0 {
+			highest = versions[len(versions)-1]
+		}
+		available.samples = append(available.samples, metricSample{t.name, float64(highest)})
+		pending.samples = append(pending.samples, metricSample{t.name, float64(count)})
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	for _, family := range []metricFamily{current, dirty, available, pending} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", family.name, family.help, family.name)
+		for _, sample := range family.samples {
+			fmt.Fprintf(w, "%s{database=\"%s\"} %s\n", family.name, labelEscaper.Replace(sample.database), strconv.FormatFloat(sample.value, 'f', -1, 64))
+		}
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package migrator
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"no proxy", []string{"203.0.113.9"}, false, "192.0.2.1"},
+		{"no header", nil, true, "192.0.2.1"},
+		{"single entry", []string{"198.51.100.7"}, true, "198.51.100.7"},
+		{"spoofed entry", []string{"203.0.113.9, 198.51.100.7"}, true, "198.51.100.7"},
+		{"spoofed header", []string{"203.0.113.9", "198.51.100.7"}, true, "198.51.100.7"},
+		{"empty entry", []string{"203.0.113.9, "}, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/version", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := clientIP(r, tt.trustProxy); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
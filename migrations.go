@@ -0,0 +1,500 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+const (
+	seqStyleSequential = "sequential"
+	seqStyleTimestamp  = "timestamp"
+
+	timestampLayout = "20060102150405"
+
+	// migrateModeUp applies, with m.Up(), whatever the source yields after
+	// the current version.
+	migrateModeUp = "up"
+	// migrateModeToLatest computes the highest version available when the
+	// run starts and migrates to it with m.Migrate(). The target is then
+	// explicit, and fixed across retries even if files are added meanwhile.
+	//
+	// NOTE: gaps in the version numbers (e.g. 1, 2, 5) are handled the same
+	// way by both modes, as the source steps to the next existing file, and
+	// both fail when the database is at a version that has no file. The
+	// difference shows with such a database ahead of the source during a
+	// rollback: m.Migrate() may then run down migrations to reach the target,
+	// while m.Up() never does.
+	migrateModeToLatest = "to-latest"
+)
+
+var (
+	defaultRetryBackoff = 1 * time.Second
+	// maxRetryBackoff caps the exponential backoff, which would otherwise
+	// overflow after enough MIGRATE_RETRIES.
+	maxRetryBackoff = 1 * time.Minute
+)
+
+// errBadDB is the MySQL error number for an unknown database.
+const errBadDB = 1049
+
+// transientErrors are the MySQL error numbers after which a failed migration
+// is expected to succeed if attempted again.
+var transientErrors = map[uint16]string{
+	1205: "lock wait timeout",
+	1213: "deadlock",
+}
+
+// checkSource verifies that dir exists and contains migration files, so that
+// the failure is not reported later as a generic one by migrate.
+func checkSource(dir string) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrMigrationsNotFound, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrMigrationsNotFound, dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, err := source.Parse(entry.Name()); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrNoMigrations, dir)
+}
+
+// checkSeqStyle verifies that all the migration files in dir are numbered
+// according to the given style, so that timestamped and sequential versions
+// never end up being mixed.
+func checkSeqStyle(dir, style string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var offending []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m, err := source.Parse(entry.Name())
+		if err != nil {
+			// not a migration file
+			continue
+		}
+		if isTimestampVersion(m.Version) != (style == seqStyleTimestamp) {
+			offending = append(offending, entry.Name())
+		}
+	}
+
+	if len(offending) > 0 {
+		return fmt.Errorf("migrations not following the %s style: %s", style, strings.Join(offending, ", "))
+	}
+
+	return nil
+}
+
+// checkDownMigrations verifies that every up migration in dir has a matching
+// down migration with the same version, and vice versa.
+func checkDownMigrations(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	ups := map[uint]string{}
+	downs := map[uint]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m, err := source.Parse(entry.Name())
+		if err != nil {
+			// not a migration file
+			continue
+		}
+		switch m.Direction {
+		case source.Up:
+			ups[m.Version] = entry.Name()
+		case source.Down:
+			downs[m.Version] = entry.Name()
+		}
+	}
+
+	var unmatched []string
+	for version, name := range ups {
+		if _, ok := downs[version]; !ok {
+			unmatched = append(unmatched, name)
+		}
+	}
+	for version, name := range downs {
+		if _, ok := ups[version]; !ok {
+			unmatched = append(unmatched, name)
+		}
+	}
+
+	if len(unmatched) > 0 {
+		slices.Sort(unmatched)
+		return fmt.Errorf("migrations without a matching up or down migration: %s", strings.Join(unmatched, ", "))
+	}
+
+	return nil
+}
+
+func isTimestampVersion(version uint) bool {
+	_, err := time.Parse(timestampLayout, strconv.FormatUint(uint64(version), 10))
+	return err == nil
+}
+
+// availableVersions lists, in order, the versions of the migrations found at
+// the given source URL.
+func availableVersions(sourceURL string) ([]uint, error) {
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	var versions []uint
+	v, err := src.First()
+	for err == nil {
+		versions = append(versions, v)
+		v, err = src.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read source: %w", err)
+	}
+
+	return versions, nil
+}
+
+// pendingVersions lists, in order, the versions that m.Up() would apply.
+func pendingVersions(m *migrate.Migrate, sourceURL string) ([]uint, error) {
+	current, _, err := currentVersion(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version: %w", err)
+	}
+	return pendingAfter(current, sourceURL)
+}
+
+// plannedVersions lists, in the order a migration from current would apply
+// them, the pending versions: only the tagged ones with MIGRATE_TAGS,
+// rearranged by the MIGRATE_ORDER_MANIFEST, and without the SKIP_VERSIONS.
+// With no migration applied yet, the ones up to the BASELINE_VERSION are left
+// out too.
+func (c Config) plannedVersions(current *uint, sourceURL string) ([]uint, error) {
+	if current == nil && c.baselineVersion != database.NilVersion {
+		baseline := uint(c.baselineVersion)
+		current = &baseline
+	}
+
+	pending, err := pendingAfter(current, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.migrateTags) > 0 {
+		manifest, err := loadTagsManifest(c.tagsManifest())
+		if err != nil {
+			return nil, err
+		}
+		pending = selectTagged(pending, manifest, c.migrateTags)
+	}
+
+	if c.migrateOrderManifest != "" {
+		order, err := loadOrderManifest(c.migrateOrderManifest)
+		if err != nil {
+			return nil, err
+		}
+		if pending, err = reorderPending(pending, order, current); err != nil {
+			return nil, err
+		}
+	}
+
+	return slices.DeleteFunc(pending, func(v uint) bool {
+		return slices.Contains(c.skipVersions, v)
+	}), nil
+}
+
+// pendingAfter lists, in order, the versions of the source above current, all
+// of them when nil.
+func pendingAfter(current *uint, sourceURL string) ([]uint, error) {
+	available, err := availableVersions(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []uint
+	for _, v := range available {
+		if current == nil || v > *current {
+			pending = append(pending, v)
+		}
+	}
+
+	return pending, nil
+}
+
+// baseline marks a database that has no migration applied yet as being at
+// the given version, without running any migration, so that only the newer
+// ones get applied. Databases with a version are left untouched.
+func baseline(m *migrate.Migrate, version int) error {
+	_, _, err := m.Version()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, migrate.ErrNilVersion) {
+		return fmt.Errorf("failed to get version: %w", err)
+	}
+
+	slog.Info("Baselining the database", "version", version)
+	return m.Force(version)
+}
+
+// checkVersion verifies that the database, at the current version, is at the
+// latest version available in the source and not dirty. Otherwise, it returns
+// an *ExitError with the exit code of the CHECK mode: 5 when migrations are
+// pending, 6 when the database is dirty.
+func checkVersion(current *uint, dirty bool, sourceURL string) error {
+	if dirty {
+		slog.Error("Database is dirty", "version", *current)
+		return &ExitError{Stage: stageCheck, Code: 6, Err: fmt.Errorf("database is dirty at version %d", *current)}
+	}
+
+	pending, err := pendingAfter(current, sourceURL)
+	if err != nil {
+		slog.Error("Failed to compute the pending migrations", "err", err)
+		return &ExitError{Stage: stageCheck, Code: 2, Err: err}
+	}
+	if len(pending) > 0 {
+		slog.Error("Migrations are pending", "pending", pending)
+		return &ExitError{Stage: stageCheck, Code: 5, Err: fmt.Errorf("migrations are pending: %v", pending)}
+	}
+
+	if current == nil {
+		slog.Info("Database is up-to-date, no migration available")
+		return nil
+	}
+	slog.Info("Database is up-to-date", "version", *current)
+	return nil
+}
+
+// upWithRetries applies the migrations according to mode or, when limit is
+// set, up to that version. Failures classified as transient are retried up to
+// retries times with an exponential backoff. Before each retry the dirty flag
+// left by the failed migration is cleared, forcing the version back to the one
+// preceding it.
+func upWithRetries(ctx context.Context, m *migrate.Migrate, sourceURL string, retries int, mode string, limit *uint) error {
+	up := m.Up
+	switch {
+	case limit != nil:
+		up = func() error {
+			return m.Migrate(*limit)
+		}
+	case mode == migrateModeToLatest:
+		available, err := availableVersions(sourceURL)
+		if err != nil {
+			return err
+		}
+		if len(available) == 0 {
+			return migrate.ErrNoChange
+		}
+		latest := available[len(available)-1]
+		slog.Debug("Migrating to the latest version", "version", latest)
+		up = func() error {
+			return m.Migrate(latest)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := up()
+		if err == nil || attempt >= retries || !isTransient(err) {
+			return err
+		}
+
+		version, dirty, verr := m.Version()
+		if verr != nil {
+			return errors.Join(err, fmt.Errorf("failed to get version: %w", verr))
+		}
+
+		if dirty {
+			prev, perr := previousVersion(sourceURL, version)
+			if perr != nil {
+				return errors.Join(err, perr)
+			}
+			if ferr := m.Force(prev); ferr != nil {
+				return errors.Join(err, fmt.Errorf("failed to clear dirty version %d: %w", version, ferr))
+			}
+		}
+
+		backoff := withJitter(retryBackoff(attempt))
+		slog.Warn("Transient migration failure, retrying",
+			"err", err, "attempt", attempt+1, "retries", retries, "backoff", backoff)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+	}
+}
+
+// retryBackoff returns the delay before retrying after the given attempt,
+// doubling from defaultRetryBackoff up to maxRetryBackoff.
+func retryBackoff(attempt int) time.Duration {
+	backoff := defaultRetryBackoff
+	for range attempt {
+		if backoff >= maxRetryBackoff/2 {
+			return maxRetryBackoff
+		}
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// skipVersions marks the pending migrations listed in skip as applied without
+// running them, first applying the migrations preceding each. The ones beyond
+// limit, when set, are left pending.
+func skipVersions(ctx context.Context, m *migrate.Migrate, sourceURL string, skip []uint, retries int, limit *uint) error {
+	pending, err := pendingVersions(m, sourceURL)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range pending {
+		if !slices.Contains(skip, version) {
+			continue
+		}
+		if limit != nil && version > *limit {
+			break
+		}
+
+		prev, err := previousVersion(sourceURL, version)
+		if err != nil {
+			return err
+		}
+		current, dirty, err := currentVersion(m)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return migrate.ErrDirty{Version: int(*current)}
+		}
+		if prev != database.NilVersion && (current == nil || *current < uint(prev)) {
+			target := uint(prev)
+			if err := upWithRetries(ctx, m, sourceURL, retries, migrateModeUp, &target); err != nil {
+				return err
+			}
+		}
+
+		slog.Warn("Skipping migration, marking it as applied without running it", "version", version)
+		if err := m.Force(int(version)); err != nil {
+			return fmt.Errorf("failed to skip version %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// driverError returns the error of the database driver wrapped in err, if
+// any, or err itself.
+func driverError(err error) error {
+	// NOTE: database.Error does not implement Unwrap, and drivers return it
+	// both by value and by pointer.
+	var dbErr database.Error
+	var dbErrPtr *database.Error
+	switch {
+	case errors.As(err, &dbErr):
+		return dbErr.OrigErr
+	case errors.As(err, &dbErrPtr):
+		return dbErrPtr.OrigErr
+	}
+	return err
+}
+
+func isTransient(err error) bool {
+	err = driverError(err)
+
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	_, ok := transientErrors[mysqlErr.Number]
+	return ok
+}
+
+// isBadConn reports whether err comes from a connection closed by the
+// database, e.g. after its wait_timeout or a restart.
+func isBadConn(err error) bool {
+	err = driverError(err)
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, sql.ErrConnDone)
+}
+
+// previousVersion returns the version preceding the given one in the
+// source, or database.NilVersion if it is the first one.
+func previousVersion(sourceURL string, version uint) (int, error) {
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	prev, err := src.Prev(version)
+	if errors.Is(err, os.ErrNotExist) {
+		return database.NilVersion, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read source: %w", err)
+	}
+
+	return int(prev), nil
+}
+
+// printPendingSQL writes to w the content of the up migrations for the given
+// versions, each preceded by a header naming it.
+func printPendingSQL(w io.Writer, sourceURL string, versions []uint) error {
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	for _, v := range versions {
+		r, identifier, err := src.ReadUp(v)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %d: %w", v, err)
+		}
+
+		fmt.Fprintf(w, "-- %d_%s.up\n", v, identifier)
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read migration %d: %w", v, err)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
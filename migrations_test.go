@@ -0,0 +1,176 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+// stubDriver is a database driver keeping the version in memory, whose Run
+// fails with a deadlock the first failures times.
+type stubDriver struct {
+	version  int
+	dirty    bool
+	failures int
+	runs     int
+}
+
+func (d *stubDriver) Open(string) (database.Driver, error) { return d, nil }
+func (d *stubDriver) Close() error                         { return nil }
+func (d *stubDriver) Lock() error                          { return nil }
+func (d *stubDriver) Unlock() error                        { return nil }
+func (d *stubDriver) Drop() error                          { return nil }
+
+func (d *stubDriver) Run(migration io.Reader) error {
+	// NOTE: read like the actual drivers do, which migrate waits for.
+	if _, err := io.ReadAll(migration); err != nil {
+		return err
+	}
+	d.runs++
+	if d.runs <= d.failures {
+		return &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	}
+	return nil
+}
+
+func (d *stubDriver) SetVersion(version int, dirty bool) error {
+	d.version, d.dirty = version, dirty
+	return nil
+}
+
+func (d *stubDriver) Version() (int, bool, error) {
+	return d.version, d.dirty, nil
+}
+
+// stubClock makes sleep return at once, recording the durations, and the
+// jitter zero, for the duration of the test.
+func stubClock(t *testing.T) *[]time.Duration {
+	t.Helper()
+
+	var slept []time.Duration
+	prevSleep, prevRand := sleep, randInt63n
+	sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return ctx.Err()
+	}
+	randInt63n = func(int64) int64 { return 0 }
+	t.Cleanup(func() { sleep, randInt63n = prevSleep, prevRand })
+	return &slept
+}
+
+// migrationsDir returns a directory with the up migrations of the given
+// versions, and its source URL.
+func migrationsDir(t *testing.T, versions ...uint) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, v := range versions {
+		name := filepath.Join(dir, fmt.Sprintf("%d_v%d.up.sql", v, v))
+		if err := os.WriteFile(name, []byte("SELECT 1;"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, "file://" + dir
+}
+
+func TestPlannedVersions(t *testing.T) {
+	dir, sourceURL := migrationsDir(t, 1, 2, 3, 4, 5)
+	order := filepath.Join(dir, "order.yaml")
+	if err := os.WriteFile(order, []byte("[4, 3]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	two := uint(2)
+	tests := []struct {
+		name    string
+		cfg     Config
+		current *uint
+		want    []uint
+	}{
+		{"no version", Config{baselineVersion: database.NilVersion}, nil, []uint{1, 2, 3, 4, 5}},
+		{"current", Config{baselineVersion: database.NilVersion}, &two, []uint{3, 4, 5}},
+		{"baseline", Config{baselineVersion: 3}, nil, []uint{4, 5}},
+		{"baseline ignored once applied", Config{baselineVersion: 3}, &two, []uint{3, 4, 5}},
+		{"skip", Config{baselineVersion: database.NilVersion, skipVersions: []uint{3, 5}}, &two, []uint{4}},
+		{"order", Config{baselineVersion: database.NilVersion, migrateOrderManifest: order}, &two, []uint{4, 3, 5}},
+		{"order and skip", Config{baselineVersion: database.NilVersion, migrateOrderManifest: order, skipVersions: []uint{4}}, &two, []uint{3, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.plannedVersions(tt.current, sourceURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("plannedVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpWithRetriesBacksOff(t *testing.T) {
+	slept := stubClock(t)
+	_, sourceURL := migrationsDir(t, 1, 2)
+
+	driver := &stubDriver{version: database.NilVersion, failures: 3}
+	m, err := migrate.NewWithDatabaseInstance(sourceURL, "stub", driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upWithRetries(context.Background(), m, sourceURL, 3, migrateModeUp, nil); err != nil {
+		t.Fatalf("upWithRetries() = %v", err)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !slices.Equal(*slept, want) {
+		t.Errorf("slept %v, want %v", *slept, want)
+	}
+	if driver.version != 2 || driver.dirty {
+		t.Errorf("version = %d, dirty %t, want 2, clean", driver.version, driver.dirty)
+	}
+}
+
+func TestUpWithRetriesGivesUp(t *testing.T) {
+	stubClock(t)
+	_, sourceURL := migrationsDir(t, 1)
+
+	driver := &stubDriver{version: database.NilVersion, failures: 3}
+	m, err := migrate.NewWithDatabaseInstance(sourceURL, "stub", driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upWithRetries(context.Background(), m, sourceURL, 2, migrateModeUp, nil); !isTransient(err) {
+		t.Errorf("upWithRetries() = %v, want the deadlock", err)
+	}
+	if driver.runs != 3 {
+		t.Errorf("ran %d times, want 3", driver.runs)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{5, 32 * time.Second},
+		{6, maxRetryBackoff},
+		{64, maxRetryBackoff},
+		{1000, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempt); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,2336 @@
+// Package migrator renders SQL templates and applies the migrations of one or
+// more MySQL databases, then serves their version over HTTP.
+//
+// The configuration is read from the environment with ConfigFromEnv, see the
+// migrator command for the available settings, or built with NewConfig and
+// the Options for the programs embedding the migrator.
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	_ "github.com/golang-migrate/migrate/v4/database/mysql"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+var (
+	defaultDelay   = 3 * time.Second
+	defaultTimeout = 5 * time.Minute
+)
+
+// Main runs the migrator command with the given arguments, not including the
+// program name, and returns the exit code of the process.
+func Main(args []string) int {
+	if len(args) > 0 && args[0] == "render" {
+		if err := renderCommand(args[1:], os.Stdin, os.Stdout); err != nil {
+			slog.Error("Failed to render the template", "err", err)
+			return fail(getenv("ERROR_FILE"), &ExitError{Stage: stageRender, Code: 1, Err: err}, nil)
+		}
+		return 0
+	}
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		slog.Error("Failed to read config", "err", err)
+		return fail(getenv("ERROR_FILE"), &ExitError{Stage: stageConfig, Code: 1, Err: err}, nil)
+	}
+
+	slog.SetDefault(setupLogger(cfg, os.Stderr))
+
+	if cfg.startupDelay > 0 {
+		slog.Info("Delaying startup", "delay", cfg.startupDelay)
+		if sig := sleepOrSignal(cfg.startupDelay); sig != nil {
+			slog.Info("Received signal during the startup delay", "signal", sig)
+			return 1
+		}
+	}
+
+	if len(args) > 0 && args[0] == "version" {
+		if err := printVersion(context.Background(), cfg); err != nil {
+			return fail(cfg.errorFile, err, cfg.passwords())
+		}
+		return 0
+	}
+
+	if len(args) > 0 && args[0] == "--render-check" {
+		if err := renderCheck(cfg); err != nil {
+			slog.Error("Failed to check the templates", "err", err)
+			return fail(cfg.errorFile, &ExitError{Stage: stageRender, Code: 1, Err: err}, cfg.passwords())
+		}
+		slog.Info("Templates render deterministically")
+		return 0
+	}
+
+	ctx := context.Background()
+
+	if cfg.showPendingSQL || cfg.check || cfg.schemaVerify != nil || cfg.execSQLFile != "" || cfg.noServe || cfg.idle {
+		srv, err := Run(ctx, cfg)
+		if err != nil {
+			return exit(cfg, fail(cfg.errorFile, err, cfg.passwords()))
+		}
+		defer srv.Close()
+
+		if cfg.showPendingSQL || cfg.check || cfg.schemaVerify != nil || cfg.execSQLFile != "" {
+			return exit(cfg, 0)
+		}
+
+		if cfg.noServe {
+			slog.Info("Migration completed, not serving")
+			return exit(cfg, 0)
+		}
+
+		slog.Info("Migration completed, idling until signalled")
+		sig := waitForSignal()
+		slog.Info("Received signal", "signal", sig)
+		return 0
+	}
+
+	// The server is started before migrating, so that probes observe the
+	// migrating phase rather than having the connection refused.
+	srv := newServer(cfg)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			slog.Info("Received signal, shutting down", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, srv)
+	}()
+
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- srv.migrateAll(ctx)
+	}()
+
+	select {
+	case err = <-migrated:
+		if err != nil && ctx.Err() != nil {
+			<-served
+			slog.Info("Execution terminated while migrating", "err", err)
+			return 1
+		} else if err != nil && cfg.continueOnError {
+			slog.Warn("Serving despite the databases that failed to migrate", "err", err)
+		} else if err != nil {
+			cancel()
+			<-served
+			return exit(cfg, fail(cfg.errorFile, err, cfg.passwords()))
+		}
+	case err = <-served:
+		// NOTE: the migrations are stopped between their steps, as ctx is
+		// cancelled on return.
+		slog.Info("Execution terminated while migrating", "err", err)
+		return 1
+	}
+	slog.Info("Migration completed, ready")
+
+	if cfg.watchInterval > 0 {
+		go srv.watchMigrations(ctx, cfg.watchInterval)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			slog.Info("Received SIGHUP, re-running migrations")
+			srv.rerun(ctx)
+		}
+	}()
+
+	err = <-served
+	slog.Info("Execution terminated", "err", err)
+	return 0
+}
+
+// Run renders the templates and applies the migrations of all the databases
+// configured in cfg. A failure is logged and reported as an *ExitError.
+// Otherwise, the returned Server holds the connections to the databases, and
+// must be closed by the caller.
+func Run(ctx context.Context, cfg Config) (*Server, error) {
+	srv := newServer(cfg)
+	if err := srv.migrateAll(ctx); err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// newServer returns a Server for the databases configured in cfg, reported as
+// migrating until migrateAll completes.
+func newServer(cfg Config) *Server {
+	srv := &Server{
+		cfg:        cfg,
+		pathPrefix: cfg.pathPrefix,
+		fieldStyle: cfg.fieldStyle,
+		accessLog:  cfg.accessLog,
+		trustProxy: cfg.trustProxy,
+		started:    now(),
+	}
+	srv.migrating.Store(true)
+	return srv
+}
+
+// migrateAll migrates all the databases configured for the server, adding
+// them to its targets, then flags it as ready. The first failure is returned.
+// With CONTINUE_ON_ERROR, the databases that failed are recorded so that they
+// are reported while serving the others, and the server is flagged as ready
+// all the same.
+func (s *Server) migrateAll(ctx context.Context) error {
+	cfg := s.cfg
+
+	// NOTE: a READY_FILE left by a previous run must not be mistaken for
+	// the outcome of this one.
+	if cfg.readyFile != "" {
+		if err := os.Remove(cfg.readyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to remove the ready file", "path", cfg.readyFile, "err", err)
+		}
+	}
+
+	var failed error
+	for _, dbCfg := range cfg.targets() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		t, err := migrateDatabase(ctx, dbCfg)
+		if err != nil {
+			if cfg.continueOnError {
+				s.mu.Lock()
+				if s.failed == nil {
+					s.failed = map[string]string{}
+				}
+				s.failed[dbCfg.name] = scrub(err.Error(), dbCfg.passwords())
+				s.mu.Unlock()
+			}
+			if dbCfg.name != "" {
+				slog.Error("Failed to migrate database", "database", dbCfg.name, "err", err)
+				err = fmt.Errorf("database %q: %w", dbCfg.name, err)
+			}
+			if failed == nil {
+				failed = err
+			}
+			if !cfg.continueOnError {
+				break
+			}
+			continue
+		}
+		if dbCfg.name != "" {
+			slog.Info("Database migrated", "database", dbCfg.name)
+		}
+
+		s.mu.Lock()
+		s.targets = append(s.targets, t)
+		s.mu.Unlock()
+	}
+
+	if failed != nil {
+		if cfg.continueOnError {
+			s.migrating.Store(false)
+		}
+		return failed
+	}
+
+	if cfg.readyFile != "" && !cfg.check && !cfg.showPendingSQL && cfg.schemaVerify == nil && cfg.execSQLFile == "" {
+		if err := s.writeReadyFile(cfg.readyFile); err != nil {
+			slog.Warn("Failed to write the ready file", "path", cfg.readyFile, "err", err)
+		}
+	}
+
+	s.migrating.Store(false)
+	return nil
+}
+
+// Render renders the templates of all the databases configured in cfg,
+// without migrating, and returns the paths of the files written.
+func Render(cfg Config) ([]string, error) {
+	var written []string
+	for _, dbCfg := range cfg.targets() {
+		files, err := dbCfg.render()
+		written = append(written, files...)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Serve serves the version of the databases migrated by Run, along with the
+// admin endpoints, until ctx is done.
+func Serve(ctx context.Context, srv *Server) error {
+	cfg := srv.cfg
+
+	var servers []*http.Server
+	if cfg.adminPort == 0 {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf("0.0.0.0:%d", cfg.port),
+			Handler: srv.handler(srv.publicRoutes, srv.adminRoutes),
+		})
+	} else {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf("0.0.0.0:%d", cfg.port),
+			Handler: srv.handler(srv.publicRoutes),
+		}, &http.Server{
+			Addr:    net.JoinHostPort(cfg.adminHost, strconv.Itoa(int(cfg.adminPort))),
+			Handler: srv.handler(srv.adminRoutes, srv.controlRoutes),
+		})
+	}
+
+	if cfg.versionRefreshInterval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		go srv.refreshVersions(ctx, cfg.versionRefreshInterval)
+	}
+
+	if cfg.listenSocket != "" {
+		servers[0].Addr = cfg.listenSocket
+	}
+
+	// NOTE: the servers are bound here, so that the admin one failing to,
+	// e.g. because the port is in use, can be told apart from it failing
+	// while serving.
+	var listeners []net.Listener
+	for i, server := range servers {
+		ln, err := listen(server.Addr, i == 0 && cfg.listenSocket != "")
+		if err != nil {
+			if i > 0 && !cfg.adminBindFatal {
+				slog.Warn("Failed to bind the admin server, serving without the admin endpoints", "addr", server.Addr, "err", err)
+				servers = servers[:i]
+				break
+			}
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return serve(ctx, servers, listeners)
+}
+
+// migrateDatabase fetches the migrations for the database described by cfg
+// and applies them. On failure, the error is logged and returned as an
+// *ExitError.
+func migrateDatabase(ctx context.Context, cfg Config) (*target, error) {
+	// NOTE: the migrations fetched into a temporary directory are removed
+	// along with the target once closed, or right away on failure.
+	var tmpDir string
+	if isGitSource(cfg.migrations) {
+		path, err := fetchGitMigrations(cfg.migrations, cfg.gitSubpath, cfg.gitCacheDir)
+		if err != nil {
+			slog.Error("Failed to fetch the migrations", "err", err)
+			return nil, &ExitError{Stage: stageFetch, Code: 1, Err: err}
+		}
+		cfg.migrations = path
+		tmpDir = path
+	}
+
+	if isArchiveSource(cfg.migrations) {
+		path, err := extractArchive(cfg.migrations)
+		if err != nil {
+			slog.Error("Failed to extract the migrations", "err", err)
+			return nil, &ExitError{Stage: stageFetch, Code: 1, Err: err}
+		}
+		cfg.migrations = path
+		tmpDir = path
+	}
+
+	t, err := openTarget(ctx, cfg)
+	if err != nil {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+		return nil, err
+	}
+	t.tmpDir = tmpDir
+	return t, nil
+}
+
+// openTarget connects to the database described by cfg, whose migrations
+// have been fetched, and applies them, or runs the EXEC_SQL_FILE or the
+// SCHEMA_VERIFY in their place.
+func openTarget(ctx context.Context, cfg Config) (*target, error) {
+	cfg.logDSN()
+
+	db, err := cfg.openDB()
+	if err != nil {
+		slog.Error("Failed to open database connection", "driver", cfg.dbDriver, "err", err)
+		return nil, &ExitError{Stage: stageConnect, Code: 2, Err: err}
+	}
+
+	t := &target{name: cfg.name, cfg: cfg, db: db}
+	if cfg.execSQLFile != "" {
+		if err := t.execSQLFile(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return t, nil
+	}
+	if cfg.schemaVerify != nil {
+		if err := t.verifySchema(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return t, nil
+	}
+	if err := t.migrate(ctx, cfg.waitForWindow); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// migrate renders the templates and applies the migrations of the target,
+// replacing its migrate instance so that newly added files are picked up.
+// On failure, the error is logged and returned as an *ExitError, and with
+// ROLLBACK_RENDER_ON_FAIL the files added by the render are removed.
+//
+// Outside of the MIGRATE_WINDOW, the window is waited for when wait is set,
+// which callers holding the lock of the server must not do. With CHECK and
+// SHOW_PENDING_SQL, nothing is changed, see inspect.
+func (t *target) migrate(ctx context.Context, wait bool) (err error) {
+	cfg := t.cfg
+	migrationsPath := cfg.migrationsPath()
+
+	ls(cfg.templates)
+
+	if cfg.check || cfg.showPendingSQL {
+		return t.inspect(ctx)
+	}
+
+	opts := cfg.renderOptions()
+	if cfg.rollbackRenderOnFail {
+		opts.existed = map[string]bool{}
+	}
+
+	written, renderErr := cfg.renderInto(cfg.migrations, opts)
+	if renderErr != nil {
+		slog.Error("Failed to render the templates", "err", renderErr)
+		return &ExitError{Stage: stageRender, Code: 1, Err: renderErr}
+	}
+	if opts.existed != nil {
+		defer func() {
+			if err != nil {
+				rollbackRender(cfg.migrations, written, opts.existed)
+			}
+		}()
+	}
+
+	ls(cfg.migrations)
+
+	if err := cfg.validateMigrations(); err != nil {
+		return err
+	}
+
+	if cfg.window != nil {
+		if err := waitForWindow(ctx, cfg.window, wait); err != nil {
+			slog.Error("Outside migration window, not migrating", "window", cfg.window.String())
+			return &ExitError{Stage: stageWindow, Code: 7, Err: err}
+		}
+	}
+
+	ddl := cfg.ddl()
+	if ddl.tokens != nil {
+		if _, err := ddl.tokens.Token(); err != nil {
+			slog.Error("Failed to get the database credentials", "err", err)
+			return &ExitError{Stage: stageConnect, Code: 2, Err: err}
+		}
+	}
+
+	slog.Debug("Starting migration", "driver", cfg.dbDriver, "migrationsPath", migrationsPath)
+
+	if cfg.createDatabase {
+		if _, err := retryFor(ctx, func(ctx context.Context) (struct{}, error) {
+			err := createDatabase(ctx, ddl)
+			if err != nil {
+				slog.Warn("Failed to create database", "err", err)
+			}
+			return struct{}{}, err
+		}, nil, defaultDelay, defaultTimeout); err != nil {
+			slog.Error("Failed to create database", "err", err)
+			return &ExitError{Stage: stageCreateDatabase, Code: 2, Err: err}
+		}
+	}
+
+	lock := t.lock()
+	m, err := retryFor(ctx, func(context.Context) (*migrate.Migrate, error) {
+		m, err := newMigrate(migrationsPath, ddl, lock)
+		if err != nil {
+			slog.Warn("Failed to instantiate migrations", "err", err)
+		}
+		return m, err
+	}, func(m *migrate.Migrate) {
+		m.Close()
+	}, defaultDelay, defaultTimeout)
+	if err != nil {
+		// NOTE: the source has been checked above, so the database is what
+		// migrate failed to open.
+		slog.Error("Failed to instantiate migrations: database unreachable", "err", err)
+		return &ExitError{Stage: stageInstantiate, Code: 2, Err: err}
+	}
+
+	m.Log = &logger{debug: cfg.debug}
+
+	// NOTE: migrate stops after the migration being applied once ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case m.GracefulStop <- true:
+		default:
+		}
+	})
+	defer stop()
+
+	if t.m != nil {
+		t.m.Close()
+	}
+	t.m = m
+
+	// NOTE: with DDL_DB_USER, the version is read as the regular user, so
+	// that serving does not need the DDL privileges. With DB_READ_URL, it is
+	// read from the replica, falling back to the primary if unreachable.
+	if cfg.ddlUser != "" || cfg.readURL != "" {
+		if err := t.openVersionReader(migrationsPath); err != nil {
+			if cfg.ddlUser != "" {
+				slog.Error("Failed to instantiate migrations for reading the version", "err", err)
+				return &ExitError{Stage: stageInstantiate, Code: 2, Err: err}
+			}
+			slog.Warn("Failed to connect to the replica, reading the version from the primary", "err", err)
+		}
+	}
+	t.invalidateVersion()
+
+	if cfg.baselineVersion != database.NilVersion {
+		if err := baseline(m, cfg.baselineVersion); err != nil {
+			slog.Error("Failed to baseline the database", "err", err)
+			return &ExitError{Stage: stageBaseline, Code: 2, Err: err}
+		}
+	}
+
+	tagged := len(cfg.migrateTags) > 0
+
+	var pending []uint
+	if cfg.logPlan || cfg.historyTable != "" || cfg.migrationLogFile != "" || tagged {
+		var err error
+		pending, err = pendingVersions(m, migrationsPath)
+		if err == nil && tagged {
+			var manifest map[uint][]string
+			if manifest, err = loadTagsManifest(cfg.tagsManifest()); err == nil {
+				pending = selectTagged(pending, manifest, cfg.migrateTags)
+			}
+		}
+		if err != nil {
+			if tagged {
+				slog.Error("Failed to compute the migration plan", "err", err)
+				return &ExitError{Stage: stagePlan, Code: 2, Err: err}
+			}
+			slog.Warn("Failed to compute the migration plan", "err", err)
+		} else if cfg.logPlan {
+			slog.Info("Migration plan", "pending", pending)
+		}
+	}
+
+	from, _, fromErr := currentVersion(m)
+	if fromErr != nil {
+		slog.Warn("Failed to get version", "err", fromErr)
+	}
+
+	var limit *uint
+	if tagged && len(pending) > 0 {
+		limit = &pending[len(pending)-1]
+	}
+
+	start := now()
+	if tagged && limit == nil {
+		err = migrate.ErrNoChange
+	} else {
+		if cfg.migrateOrderManifest != "" {
+			var order []uint
+			if order, err = loadOrderManifest(cfg.migrateOrderManifest); err == nil {
+				err = applyOrdered(ctx, m, ddl, t.lock(), migrationsPath, order, cfg.skipVersions, cfg.migrateRetries)
+			}
+		}
+		if err == nil && len(cfg.skipVersions) > 0 {
+			err = skipVersions(ctx, m, migrationsPath, cfg.skipVersions, cfg.migrateRetries, limit)
+		}
+		if err == nil {
+			err = upWithRetries(ctx, m, migrationsPath, cfg.migrateRetries, cfg.migrateMode, limit)
+		}
+	}
+	t.lastDuration = since(start)
+	t.lastOutcome = runOutcome(err)
+
+	if cfg.migrationLogFile != "" || len(cfg.notifyTargets) > 0 {
+		rec, recErr := t.newRunRecord(from, pending, err)
+		if recErr != nil {
+			slog.Warn("Failed to describe the migration run", "err", recErr)
+		}
+		if cfg.migrationLogFile != "" {
+			if err := t.logRun(rec); err != nil {
+				slog.Warn("Failed to write the migration log", "err", err)
+			}
+		}
+		if len(cfg.notifyTargets) > 0 {
+			if err := t.notify(rec); err != nil {
+				slog.Warn("Failed to send the notification", "err", err)
+			}
+		}
+	}
+
+	if cfg.historyTable != "" {
+		if err := t.recordHistory(pending); err != nil {
+			slog.Warn("Failed to record the migration history", "err", err)
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, migrate.ErrNoChange) {
+			slog.Info("Already up-to-date")
+		} else {
+			t.errorCount++
+			slog.Error("Failed to migrate", "err", err)
+			return &ExitError{Stage: stageMigrate, Code: 3, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// inspect checks, with CHECK, that the database is up-to-date or prints, with
+// SHOW_PENDING_SQL, the migrations that would be applied, without changing
+// anything: the templates are rendered into a copy of the migrations, and the
+// version is read without the migrate driver, which would create its table.
+// The database is not created either.
+func (t *target) inspect(ctx context.Context) error {
+	cfg := t.cfg
+
+	dir, err := cfg.renderCopy()
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		slog.Error("Failed to render the templates", "err", err)
+		return &ExitError{Stage: stageRender, Code: 1, Err: err}
+	}
+	cfg.migrations = dir
+
+	if err := cfg.validateMigrations(); err != nil {
+		return err
+	}
+
+	current, dirty, err := readVersion(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.check {
+		return checkVersion(current, dirty, cfg.migrationsPath())
+	}
+
+	pending, err := cfg.plannedVersions(current, cfg.migrationsPath())
+	if err != nil {
+		slog.Error("Failed to compute the migration plan", "err", err)
+		return &ExitError{Stage: stagePlan, Code: 2, Err: err}
+	}
+	if cfg.logPlan {
+		slog.Info("Migration plan", "pending", pending)
+	}
+
+	if err := printPendingSQL(os.Stdout, cfg.migrationsPath(), pending); err != nil {
+		slog.Error("Failed to print the pending migrations", "err", err)
+		return &ExitError{Stage: stagePlan, Code: 1, Err: err}
+	}
+	return nil
+}
+
+// validateMigrations checks the migration files, returning an *ExitError if
+// there are none or, with SEQ_STYLE and REQUIRE_DOWN_MIGRATIONS, if they are
+// not named or paired as required.
+func (c Config) validateMigrations() error {
+	if err := checkSource(c.migrations); err != nil {
+		switch {
+		case errors.Is(err, ErrMigrationsNotFound):
+			slog.Error("Migrations path does not exist", "path", c.migrations, "err", err)
+		case errors.Is(err, ErrNoMigrations):
+			slog.Error("Migrations path contains no migration files", "path", c.migrations)
+		default:
+			slog.Error("Failed to read the migrations", "err", err)
+		}
+		return &ExitError{Stage: stageValidate, Code: 2, Err: err}
+	}
+
+	if c.seqStyle != "" {
+		if err := checkSeqStyle(c.migrations, c.seqStyle); err != nil {
+			slog.Error("Invalid migration files", "err", err)
+			return &ExitError{Stage: stageValidate, Code: 1, Err: err}
+		}
+	}
+
+	if c.requireDown {
+		if err := checkDownMigrations(c.migrations); err != nil {
+			slog.Error("Invalid migration files", "err", err)
+			return &ExitError{Stage: stageValidate, Code: 1, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// fail writes err to the ERROR_FILE at path, if set, with the passwords
+// masked, and returns the exit code for the process.
+func fail(path string, err error, passwords []string) int {
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		exitErr = &ExitError{Stage: stageMigrate, Code: 1, Err: err}
+	}
+
+	if path != "" {
+		if writeErr := exitErr.write(path, passwords); writeErr != nil {
+			slog.Warn("Failed to write the error file", "err", writeErr)
+		}
+	}
+
+	return exitErr.Code
+}
+
+// setupLogger returns the logger writing to w as configured by cfg, masking
+// the database passwords. The debug messages are only logged with DEBUG.
+//
+// The records are written in the standard log format, or as key=value pairs
+// only with LOG_FORMAT=text.
+func setupLogger(cfg Config, w io.Writer) *slog.Logger {
+	level := slog.LevelInfo
+	if cfg.debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{
+		AddSource: cfg.logSource,
+		Level:     level,
+	}
+
+	var handler slog.Handler
+	if cfg.logFormat == logFormatText {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = newStdHandler(w, opts)
+	}
+	return slog.New(scrubHandler{
+		Handler:   handler,
+		passwords: cfg.passwords(),
+	})
+}
+
+// printVersion prints the current schema version of every database to stdout,
+// prefixed with its name when DATABASES is set, and its dirty status to
+// stderr. On failure, the error of the first database that failed is returned
+// as an *ExitError, after the others have been printed.
+func printVersion(ctx context.Context, cfg Config) error {
+	var firstErr error
+	for _, c := range cfg.targets() {
+		prefix := ""
+		if c.name != "" {
+			prefix = c.name + ": "
+		}
+
+		version, dirty, err := readVersion(ctx, c)
+		if err == nil && version == nil {
+			fmt.Fprintln(os.Stderr, prefix+"No migration has been applied yet")
+			err = &ExitError{Stage: stageVersion, Code: 4, Err: errors.New("no migration has been applied yet")}
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		fmt.Printf("%s%d\n", prefix, *version)
+		fmt.Fprintf(os.Stderr, "%sdirty: %t\n", prefix, dirty)
+	}
+	return firstErr
+}
+
+// readVersion reads the version of the database described by c, nil if no
+// migration has been applied yet. It is read directly from the migrations
+// table, rather than through the migrate driver, which would create the table
+// if missing. On failure, the error is logged and returned as an *ExitError.
+func readVersion(ctx context.Context, c Config) (*uint, bool, error) {
+	connector, err := c.connector(c.mysqlConfig())
+	if err != nil {
+		slog.Error("Failed to get the database credentials", "target", c.name, "err", err)
+		return nil, false, &ExitError{Stage: stageConnect, Code: 2, Err: err}
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if c.createDatabase && errors.As(err, &mysqlErr) && mysqlErr.Number == errBadDB {
+			// NOTE: the database would be created, with no migration
+			// applied.
+			return nil, false, nil
+		}
+		slog.Error("Failed to connect to the database", "target", c.name, "driver", c.dbDriver, "err", err)
+		return nil, false, &ExitError{Stage: stageConnect, Code: 2, Err: err}
+	}
+
+	table := c.versionTable()
+	quoted, err := quoteIdentifier(table)
+	if err != nil {
+		return nil, false, &ExitError{Stage: stageVersion, Code: 2, Err: err}
+	}
+
+	var exists bool
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table)
+	if err := row.Scan(&exists); err != nil {
+		slog.Error("Failed to get version", "target", c.name, "err", err)
+		return nil, false, &ExitError{Stage: stageVersion, Code: 2, Err: err}
+	}
+	if !exists {
+		return nil, false, nil
+	}
+
+	var (
+		version int64
+		dirty   bool
+	)
+	// NOTE: migrate keeps a single row, removed when migrated down to no
+	// version.
+	err = db.QueryRowContext(ctx, "SELECT version, dirty FROM "+quoted+" LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		slog.Error("Failed to get version", "target", c.name, "err", err)
+		return nil, false, &ExitError{Stage: stageVersion, Code: 2, Err: err}
+	}
+	if version < 0 {
+		return nil, false, nil
+	}
+
+	vers := uint(version)
+	return &vers, dirty, nil
+}
+
+// Config is the configuration of the migrator, as returned by ConfigFromEnv
+// or NewConfig.
+type Config struct {
+	dbUser string
+	dbPass string
+	dbHost string
+	dbPort uint16
+	dbName string
+
+	// dbDriver is only a label, MariaDB is served by the mysql driver too.
+	dbDriver string
+
+	// dbURL is set from DB_URL_TEMPLATE, and takes the place of the fields
+	// above.
+	dbURL     string
+	urlConfig *mysql.Config
+
+	// tokens is set when DB_AUTH=iam, and takes the place of dbPass.
+	tokens *tokenSource
+
+	// ddlUser and ddlPass, when set, take the place of the regular
+	// credentials to apply the migrations.
+	ddlUser string
+	ddlPass string
+
+	// readURL is set from DB_READ_URL, the replica the version is read
+	// from while serving, and readConfig from its parsed settings.
+	readURL    string
+	readConfig *mysql.Config
+
+	// migrationsTable is set from MIGRATIONS_TABLE_PREFIX, and passed to
+	// the migrate driver in place of its default table.
+	migrationsTable string
+
+	// lockName is set from LOCK_NAME, the advisory lock taken while
+	// migrating in place of the one the migrate driver derives from the
+	// database and migrations table names.
+	lockName string
+
+	maxOpenConns           int
+	versionCacheTTL        time.Duration
+	versionRefreshInterval time.Duration
+	versionStaleOK         bool
+
+	// watchInterval is how often the migrations sources are checked for new
+	// versions while serving.
+	watchInterval time.Duration
+
+	createDatabase bool
+	dbCharset      string
+	dbCollation    string
+
+	migrations string
+	templates  string
+	port       uint16
+	pathPrefix string
+	fieldStyle string
+	accessLog  bool
+	trustProxy bool
+	adminHost  string
+	adminPort  uint16
+	noServe    bool
+	idle       bool
+	holdOpen   bool
+	debug      bool
+	logPlan    bool
+	logSource  bool
+	appName    string
+	seqStyle   string
+
+	// listenSocket, when set, is the path of the Unix socket served on in
+	// place of the port.
+	listenSocket string
+
+	// adminBindFatal makes failing to bind the ADMIN_PORT fatal, rather
+	// than serving without the admin endpoints.
+	adminBindFatal bool
+
+	// startupDelay is waited for before anything else is done.
+	startupDelay time.Duration
+
+	// logFormat is set from LOG_FORMAT, the standard log format unless
+	// "text".
+	logFormat string
+
+	gitSubpath  string
+	gitCacheDir string
+
+	migrateRetries int
+	migrateMode    string
+
+	// baselineVersion is database.NilVersion unless BASELINE_VERSION is set.
+	baselineVersion int
+
+	migrateTags         []string
+	migrateTagsManifest string
+
+	// skipVersions are marked as applied, without running them, when
+	// pending.
+	skipVersions []uint
+
+	// migrateOrderManifest lists pending versions to be applied in a
+	// different order than their numbering.
+	migrateOrderManifest string
+
+	window        *migrateWindow
+	waitForWindow bool
+
+	templateEnvAllow     []string
+	templateEnvPrefixes  []string
+	templateEnvMax       int
+	normalizeLineEndings bool
+	postRenderCmd        []string
+	strictSecrets        bool
+	templateStrict       bool
+	renderStateFile      string
+	renderConcurrency    int
+	renderOverwrite      bool
+	cleanRenderDir       bool
+	rollbackRenderOnFail bool
+	maxFileSize          int64
+
+	historyTable     string
+	deployID         string
+	migrationLogFile string
+
+	requireDown bool
+
+	// notifyTargets are the NOTIFY_URL and NOTIFY_TARGETS webhooks.
+	notifyTargets []notifyTarget
+	notifyClient  *http.Client
+
+	showPendingSQL bool
+	check          bool
+
+	// schemaVerify is set from SCHEMA_VERIFY, and takes the place of the
+	// migration.
+	schemaVerify expectedSchema
+
+	// execSQLFile is set from EXEC_SQL_FILE, whose statements are run in
+	// place of the migration, when allowed by EXEC_SQL_ALLOW.
+	execSQLFile string
+
+	errorFile string
+	readyFile string
+
+	// name is only set for the entries of DATABASES
+	name            string
+	databases       []Config
+	continueOnError bool
+}
+
+// targets returns the configs of all the databases to be migrated.
+func (c Config) targets() []Config {
+	if len(c.databases) > 0 {
+		return c.databases
+	}
+	return []Config{c}
+}
+
+func (c Config) url() string {
+	if c.dbURL != "" {
+		return c.withMigrationsTable(c.dbURL)
+	}
+	dbURL := fmt.Sprintf(
+		"mysql://%s:%s@tcp(%s:%d)/%s?connectionAttributes=%s",
+		url.QueryEscape(c.dbUser),
+		url.QueryEscape(c.dbPass),
+		url.QueryEscape(c.dbHost),
+		c.dbPort,
+		url.QueryEscape(c.dbName),
+		url.QueryEscape("program_name:"+c.appName),
+	)
+	if c.tokens != nil {
+		dbURL += "&allowCleartextPasswords=true"
+	}
+	if c.migrationsTable != "" {
+		dbURL += "&x-migrations-table=" + url.QueryEscape(c.migrationsTable)
+	}
+	return dbURL
+}
+
+// versionTable returns the table the migrate driver tracks the version in.
+func (c Config) versionTable() string {
+	if c.migrationsTable != "" {
+		return c.migrationsTable
+	}
+	if table := c.urlParam("x-migrations-table"); table != "" {
+		return table
+	}
+	return defaultMigrationsTable
+}
+
+// urlParam returns the value of the parameter name of DB_URL_TEMPLATE, empty
+// if not set.
+func (c Config) urlParam(name string) string {
+	_, query, ok := strings.Cut(c.dbURL, "?")
+	if !ok {
+		return ""
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	return values.Get(name)
+}
+
+// withMigrationsTable adds the MIGRATIONS_TABLE_PREFIX table, if any, to the
+// parameters of dbURL.
+func (c Config) withMigrationsTable(dbURL string) string {
+	if c.migrationsTable == "" {
+		return dbURL
+	}
+	return withParam(dbURL, "x-migrations-table", c.migrationsTable)
+}
+
+// withParam adds the parameter name, set to value, to dbURL.
+func withParam(dbURL, name, value string) string {
+	sep := "?"
+	if strings.Contains(dbURL, "?") {
+		sep = "&"
+	}
+	return dbURL + sep + name + "=" + url.QueryEscape(value)
+}
+
+func (c Config) migrationsPath() string {
+	return fmt.Sprintf("file://%s", c.migrations)
+}
+
+// ConfigFromEnv reads the configuration from the environment, extended with
+// the ENV_FILE, and, when set, from the CONFIG_FILE.
+func ConfigFromEnv() (c Config, err error) {
+	if envErr := loadEnvFile(); envErr != nil {
+		err = &ConfigError{Var: "ENV_FILE", Err: envErr}
+		return
+	}
+
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		if fileErr := loadConfigFile(configFile); fileErr != nil {
+			err = &ConfigError{Var: "CONFIG_FILE", Err: fileErr}
+			return
+		}
+	} else if os.Getenv("PROFILE") != "" {
+		err = &ConfigError{Var: "PROFILE", Err: fmt.Errorf("profiles are defined in the CONFIG_FILE, which is not set")}
+		return
+	}
+
+	if len(fileDatabases) == 0 {
+		return readConfig()
+	}
+
+	// NOTE: the settings that are not specific to a database are taken from
+	// the first entry, so entries should only override database settings.
+	names := map[string]bool{}
+	for i, values := range fileDatabases {
+		name := values["NAME"]
+		if name == "" {
+			err = &ConfigError{Var: fmt.Sprintf("DATABASES[%d].NAME", i)}
+			return
+		}
+		if names[name] {
+			err = &ConfigError{Var: fmt.Sprintf("DATABASES[%d].NAME", i), Err: fmt.Errorf("duplicate database %q", name)}
+			return
+		}
+		names[name] = true
+
+		overrides = values
+		dbCfg, dbErr := readConfig()
+		overrides = nil
+		if dbErr != nil {
+			err = fmt.Errorf("config for database %q: %w", name, dbErr)
+			return
+		}
+		dbCfg.name = name
+
+		c.databases = append(c.databases, dbCfg)
+	}
+
+	databases := c.databases
+	c = databases[0]
+	c.databases = databases
+
+	return
+}
+
+func readConfig() (c Config, err error) {
+	c = defaultConfig()
+
+	if urlTemplate := getenv("DB_URL_TEMPLATE"); urlTemplate != "" {
+		dbURL, urlConfig, urlErr := renderURL(urlTemplate)
+		if urlErr != nil {
+			err = &ConfigError{Var: "DB_URL_TEMPLATE", Err: urlErr}
+			return
+		}
+		c.dbURL = dbURL
+		c.urlConfig = urlConfig
+	}
+
+	dbUser, err := getenvOrFile("DB_USER")
+	if err != nil {
+		return
+	}
+	if dbUser == "" && c.dbURL == "" {
+		err = &ConfigError{Var: "DB_USER"}
+		return
+	}
+	c.dbUser = dbUser
+
+	dbAuth := getenv("DB_AUTH")
+	switch dbAuth {
+	case "":
+	case dbAuthIAM:
+		authCmd := strings.Fields(getenv("DB_AUTH_CMD"))
+		if len(authCmd) == 0 {
+			err = &ConfigError{Var: "DB_AUTH_CMD"}
+			return
+		}
+		ttl, ttlErr := getDuration("DB_AUTH_TOKEN_TTL", defaultTokenTTL)
+		if ttlErr != nil {
+			err = ttlErr
+			return
+		}
+		c.tokens = &tokenSource{cmd: authCmd, ttl: ttl}
+	default:
+		err = &ConfigError{Var: "DB_AUTH", Err: fmt.Errorf("%q must be %q", dbAuth, dbAuthIAM)}
+		return
+	}
+
+	dbPass, err := getenvOrFile("DB_PASS")
+	if err != nil {
+		return
+	}
+	if dbPass == "" && c.dbURL == "" && c.tokens == nil {
+		err = &ConfigError{Var: "DB_PASS"}
+		return
+	}
+	c.dbPass = dbPass
+
+	if readURL := getenv("DB_READ_URL"); readURL != "" {
+		// NOTE: rendered like DB_URL_TEMPLATE, mostly to validate it.
+		if c.readURL, c.readConfig, err = renderURL(readURL); err != nil {
+			err = &ConfigError{Var: "DB_READ_URL", Err: err}
+			return
+		}
+	}
+
+	ddlUser, err := getenvOrFile("DDL_DB_USER")
+	if err != nil {
+		return
+	}
+	if ddlUser != "" {
+		ddlPass, passErr := getenvOrFile("DDL_DB_PASS")
+		if passErr != nil {
+			err = passErr
+			return
+		}
+		if ddlPass == "" {
+			err = &ConfigError{Var: "DDL_DB_PASS"}
+			return
+		}
+		c.ddlUser, c.ddlPass = ddlUser, ddlPass
+	}
+
+	dbHost := getenv("DB_HOST")
+	if dbHost == "" && c.dbURL == "" {
+		err = &ConfigError{Var: "DB_HOST"}
+		return
+	}
+	c.dbHost = dbHost
+
+	dbPort, err := getPort("DB_PORT", c.dbPort)
+	if err != nil {
+		return
+	}
+	c.dbPort = dbPort
+
+	dbDriver := getenv("DB_DRIVER")
+	switch dbDriver {
+	case "":
+		dbDriver = c.dbDriver
+	case dbDriverMySQL, dbDriverMariaDB:
+	default:
+		err = &ConfigError{Var: "DB_DRIVER", Err: fmt.Errorf("%q must be %q or %q", dbDriver, dbDriverMySQL, dbDriverMariaDB)}
+		return
+	}
+	c.dbDriver = dbDriver
+
+	// NOTE: there is no default, as the mysql schema that both MySQL and
+	// MariaDB connect to otherwise is the system one.
+	dbName := getenv("DB_NAME")
+	if dbName == "" && c.dbURL == "" {
+		err = &ConfigError{Var: "DB_NAME"}
+		return
+	}
+	c.dbName = dbName
+
+	if c.urlConfig != nil {
+		c.dbName = c.urlConfig.DBName
+	}
+
+	maxOpenConns, err := getInt("DB_MAX_OPEN_CONNS", 0)
+	if err != nil {
+		return
+	}
+	c.maxOpenConns = maxOpenConns
+
+	versionCacheTTL, err := getDuration("VERSION_CACHE_TTL", c.versionCacheTTL)
+	if err != nil {
+		return
+	}
+	c.versionCacheTTL = versionCacheTTL
+
+	versionRefreshInterval, err := getDuration("VERSION_REFRESH_INTERVAL", 0)
+	if err != nil {
+		return
+	}
+	c.versionRefreshInterval = versionRefreshInterval
+
+	watchInterval, err := getDuration("WATCH_INTERVAL", 0)
+	if err != nil {
+		return
+	}
+	c.watchInterval = watchInterval
+
+	if getenv("VERSION_STALE_OK") != "" {
+		c.versionStaleOK = true
+	}
+
+	if getenv("CREATE_DATABASE_IF_MISSING") != "" {
+		c.createDatabase = true
+		c.dbCharset = getenv("DB_CHARSET")
+		c.dbCollation = getenv("DB_COLLATION")
+
+		for env, ident := range map[string]string{
+			"DB_NAME":      c.dbName,
+			"DB_CHARSET":   c.dbCharset,
+			"DB_COLLATION": c.dbCollation,
+		} {
+			if ident == "" {
+				continue
+			}
+			if identErr := validateIdentifier(ident); identErr != nil {
+				err = &ConfigError{Var: env, Err: identErr}
+				return
+			}
+		}
+	}
+
+	// NOTE: with REQUIRE_EXPLICIT_PATHS, MIGRATIONS and TEMPLATES have no
+	// default, so that an omission does not pick up an unexpected directory.
+	explicitPaths := getenv("REQUIRE_EXPLICIT_PATHS") != ""
+
+	migrations := getenv("MIGRATIONS")
+	if migrations == "" {
+		if explicitPaths {
+			err = &ConfigError{Var: "MIGRATIONS"}
+			return
+		}
+		migrations = c.migrations
+	}
+	c.migrations = migrations
+
+	if isGitSource(migrations) {
+		gitSubpath := getenv("MIGRATIONS_GIT_SUBPATH")
+		if gitSubpath == "" {
+			gitSubpath = "."
+		}
+		if !filepath.IsLocal(gitSubpath) {
+			err = &ConfigError{Var: "MIGRATIONS_GIT_SUBPATH", Err: fmt.Errorf("%q must be a relative path inside the repository", gitSubpath)}
+			return
+		}
+		c.gitSubpath = gitSubpath
+
+		gitCacheDir := getenv("MIGRATIONS_GIT_CACHE")
+		if gitCacheDir == "" {
+			gitCacheDir = filepath.Join(os.TempDir(), "migrator-git")
+		}
+		c.gitCacheDir = gitCacheDir
+	}
+
+	templates := getenv("TEMPLATES")
+	if templates == "" {
+		if explicitPaths {
+			err = &ConfigError{Var: "TEMPLATES"}
+			return
+		}
+		templates = c.templates
+	}
+	c.templates = templates
+
+	// NOTE: migrate parses the templates, e.g. 1_init.up.sql.tmpl, as
+	// migrations too, which then clash with the files rendered from them.
+	if !isGitSource(migrations) && !isArchiveSource(migrations) && sameDir(migrations, templates) {
+		err = &ConfigError{Var: "TEMPLATES", Err: fmt.Errorf("%q is also the MIGRATIONS directory, where the templates would be taken for migrations", templates)}
+		return
+	}
+
+	if err = c.readRenderConfig(); err != nil {
+		return
+	}
+
+	c.renderStateFile = getenv("RENDER_STATE_FILE")
+
+	renderConcurrency, err := getInt("RENDER_CONCURRENCY", c.renderConcurrency)
+	if err != nil {
+		return
+	}
+	c.renderConcurrency = renderConcurrency
+
+	renderOverwrite, err := getBool("RENDER_OVERWRITE", false)
+	if err != nil {
+		return
+	}
+	c.renderOverwrite = renderOverwrite
+
+	cleanRenderDir, err := getBool("CLEAN_RENDER_DIR", false)
+	if err != nil {
+		return
+	}
+	c.cleanRenderDir = cleanRenderDir
+
+	rollbackRenderOnFail, err := getBool("ROLLBACK_RENDER_ON_FAIL", false)
+	if err != nil {
+		return
+	}
+	c.rollbackRenderOnFail = rollbackRenderOnFail
+
+	maxFileSize, err := getSize("MAX_MIGRATION_FILE_SIZE", c.maxFileSize)
+	if err != nil {
+		return
+	}
+	c.maxFileSize = maxFileSize
+
+	// NOTE: the command is split on whitespace and not run through a shell.
+	c.postRenderCmd = strings.Fields(getenv("POST_RENDER_CMD"))
+
+	port, err := getPort("PORT", c.port)
+	if err != nil {
+		return
+	}
+	c.port = port
+
+	c.listenSocket = getenv("LISTEN_SOCKET")
+
+	fieldStyle := getenv("JSON_FIELD_STYLE")
+	switch fieldStyle {
+	case "", fieldStyleSnakeCase, fieldStyleCamelCase:
+	default:
+		err = &ConfigError{Var: "JSON_FIELD_STYLE", Err: fmt.Errorf("%q must be %q or %q", fieldStyle, fieldStyleSnakeCase, fieldStyleCamelCase)}
+		return
+	}
+	c.fieldStyle = fieldStyle
+
+	if getenv("ACCESS_LOG") != "" {
+		c.accessLog = true
+	}
+
+	if getenv("TRUST_PROXY") != "" {
+		c.trustProxy = true
+	}
+
+	adminPort, err := getPort("ADMIN_PORT", 0)
+	if err != nil {
+		return
+	}
+	c.adminPort = adminPort
+
+	// NOTE: the admin endpoints are not authenticated, so they are only
+	// reachable from outside when ADMIN_HOST says so.
+	adminHost := getenv("ADMIN_HOST")
+	if adminHost == "" {
+		adminHost = c.adminHost
+	}
+	c.adminHost = adminHost
+
+	c.adminBindFatal, err = getBool("ADMIN_BIND_FATAL", c.adminBindFatal)
+	if err != nil {
+		return
+	}
+
+	pathPrefix := strings.TrimSuffix(getenv("HTTP_PATH_PREFIX"), "/")
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		err = &ConfigError{Var: "HTTP_PATH_PREFIX", Err: fmt.Errorf("%q must start with /", pathPrefix)}
+		return
+	}
+	c.pathPrefix = pathPrefix
+
+	if getenv("NO_SERVE") != "" {
+		c.noServe = true
+	}
+
+	if getenv("IDLE_SIDECAR") != "" {
+		if c.noServe {
+			err = &ConfigError{Var: "IDLE_SIDECAR", Err: errors.New("cannot be set together with NO_SERVE")}
+			return
+		}
+		c.idle = true
+	}
+
+	if getenv("HOLD_OPEN") != "" {
+		c.holdOpen = true
+	}
+
+	startupDelay, err := getDuration("STARTUP_DELAY", 0)
+	if err != nil {
+		return
+	}
+	c.startupDelay = startupDelay
+
+	if getenv("DEBUG") != "" {
+		c.debug = true
+	}
+
+	logPlan, err := getBool("LOG_PLAN", c.debug)
+	if err != nil {
+		return
+	}
+	c.logPlan = logPlan
+
+	logSource, err := getBool("LOG_SOURCE", c.debug)
+	if err != nil {
+		return
+	}
+	c.logSource = logSource
+
+	logFormat := getenv("LOG_FORMAT")
+	switch logFormat {
+	case "", logFormatText:
+	default:
+		err = &ConfigError{Var: "LOG_FORMAT", Err: fmt.Errorf("%q must be %q", logFormat, logFormatText)}
+		return
+	}
+	c.logFormat = logFormat
+
+	if getenv("CONTINUE_ON_ERROR") != "" {
+		c.continueOnError = true
+	}
+
+	migrateRetries, err := getInt("MIGRATE_RETRIES", 0)
+	if err != nil {
+		return
+	}
+	if migrateRetries < 0 {
+		err = &ConfigError{Var: "MIGRATE_RETRIES", Err: fmt.Errorf("%d must not be negative", migrateRetries)}
+		return
+	}
+	c.migrateRetries = migrateRetries
+
+	migrateMode := getenv("MIGRATE_MODE")
+	switch migrateMode {
+	case "":
+		migrateMode = c.migrateMode
+	case migrateModeUp, migrateModeToLatest:
+	default:
+		err = &ConfigError{Var: "MIGRATE_MODE", Err: fmt.Errorf("%q must be %q or %q", migrateMode, migrateModeUp, migrateModeToLatest)}
+		return
+	}
+	c.migrateMode = migrateMode
+
+	if tags := getenv("MIGRATE_TAGS"); tags != "" {
+		c.migrateTags = splitList(tags)
+	}
+	c.migrateTagsManifest = getenv("MIGRATE_TAGS_MANIFEST")
+
+	if c.migrateOrderManifest = getenv("MIGRATE_ORDER_MANIFEST"); c.migrateOrderManifest != "" && len(c.migrateTags) > 0 {
+		err = &ConfigError{Var: "MIGRATE_ORDER_MANIFEST", Err: fmt.Errorf("cannot be combined with MIGRATE_TAGS")}
+		return
+	}
+
+	if skip := getenv("SKIP_VERSIONS"); skip != "" {
+		for _, value := range splitList(skip) {
+			version, parseErr := strconv.ParseUint(value, 10, 0)
+			if parseErr != nil {
+				err = &ConfigError{Var: "SKIP_VERSIONS", Err: fmt.Errorf("%q is not a version", value)}
+				return
+			}
+			c.skipVersions = append(c.skipVersions, uint(version))
+		}
+	}
+
+	if window := getenv("MIGRATE_WINDOW"); window != "" {
+		if c.window, err = parseWindow(window); err != nil {
+			err = &ConfigError{Var: "MIGRATE_WINDOW", Err: err}
+			return
+		}
+		if getenv("WAIT_FOR_WINDOW") != "" {
+			c.waitForWindow = true
+		}
+	}
+
+	baselineVersion, err := getInt("BASELINE_VERSION", c.baselineVersion)
+	if err != nil {
+		return
+	}
+	if baselineVersion < database.NilVersion {
+		err = &ConfigError{Var: "BASELINE_VERSION", Err: fmt.Errorf("%d must not be negative", baselineVersion)}
+		return
+	}
+	c.baselineVersion = baselineVersion
+
+	appName := getenv("APP_NAME")
+	if appName == "" {
+		appName = c.appName
+	}
+	c.appName = appName
+
+	if getenv("SHOW_PENDING_SQL") != "" {
+		c.showPendingSQL = true
+	}
+
+	if getenv("CHECK") != "" {
+		c.check = true
+	}
+
+	if path := getenv("SCHEMA_VERIFY"); path != "" {
+		if c.schemaVerify, err = loadExpectedSchema(path); err != nil {
+			err = &ConfigError{Var: "SCHEMA_VERIFY", Err: err}
+			return
+		}
+	}
+
+	if c.execSQLFile = getenv("EXEC_SQL_FILE"); c.execSQLFile != "" {
+		allowed, boolErr := getBool("EXEC_SQL_ALLOW", false)
+		if boolErr != nil {
+			err = boolErr
+			return
+		}
+		if !allowed {
+			err = &ConfigError{Var: "EXEC_SQL_FILE", Err: errors.New("runs statements outside of the migrations, set EXEC_SQL_ALLOW=true to allow it")}
+			return
+		}
+	}
+
+	c.errorFile = getenv("ERROR_FILE")
+	c.readyFile = getenv("READY_FILE")
+
+	if getenv("REQUIRE_DOWN_MIGRATIONS") != "" {
+		c.requireDown = true
+	}
+
+	if prefix := getenv("MIGRATIONS_TABLE_PREFIX"); prefix != "" {
+		if c.urlConfig != nil && c.urlConfig.Params["x-migrations-table"] != "" {
+			err = &ConfigError{Var: "MIGRATIONS_TABLE_PREFIX", Err: fmt.Errorf("x-migrations-table already set in DB_URL_TEMPLATE")}
+			return
+		}
+		table := prefix + "_" + defaultMigrationsTable
+		if identErr := validateIdentifier(table); identErr != nil {
+			err = &ConfigError{Var: "MIGRATIONS_TABLE_PREFIX", Err: identErr}
+			return
+		}
+		c.migrationsTable = table
+	}
+
+	if c.lockName = getenv("LOCK_NAME"); c.lockName != "" && !validLockName.MatchString(c.lockName) {
+		err = &ConfigError{Var: "LOCK_NAME", Err: fmt.Errorf("invalid lock name %q: only up to 255 letters, digits and _.:/- are allowed", c.lockName)}
+		return
+	}
+
+	historyTable := getenv("HISTORY_TABLE")
+	if historyTable != "" {
+		if identErr := validateIdentifier(historyTable); identErr != nil {
+			err = &ConfigError{Var: "HISTORY_TABLE", Err: identErr}
+			return
+		}
+	}
+	c.historyTable = historyTable
+	c.deployID = getenv("DEPLOY_ID")
+	c.migrationLogFile = getenv("MIGRATION_LOG_FILE")
+
+	if notifyURL := getenv("NOTIFY_URL"); notifyURL != "" {
+		if _, urlErr := url.ParseRequestURI(notifyURL); urlErr != nil {
+			err = &ConfigError{Var: "NOTIFY_URL", Err: errors.Unwrap(urlErr)}
+			return
+		}
+		c.notifyTargets = append(c.notifyTargets, notifyTarget{URL: notifyURL})
+	}
+
+	if targets := getenv("NOTIFY_TARGETS"); targets != "" {
+		notifyTargets, parseErr := parseNotifyTargets(targets)
+		if parseErr != nil {
+			err = &ConfigError{Var: "NOTIFY_TARGETS", Err: parseErr}
+			return
+		}
+		c.notifyTargets = append(c.notifyTargets, notifyTargets...)
+	}
+
+	if len(c.notifyTargets) > 0 {
+		insecure, boolErr := getBool("NOTIFY_INSECURE_SKIP_VERIFY", false)
+		if boolErr != nil {
+			err = boolErr
+			return
+		}
+
+		timeout, timeoutErr := getDuration("NOTIFY_TIMEOUT", defaultNotifyTimeout)
+		if timeoutErr != nil {
+			err = timeoutErr
+			return
+		}
+
+		client, clientErr := newNotifyClient(getenv("NOTIFY_CA_FILE"), insecure, timeout)
+		if clientErr != nil {
+			err = &ConfigError{Var: "NOTIFY_CA_FILE", Err: clientErr}
+			return
+		}
+		c.notifyClient = client
+	}
+
+	seqStyle := getenv("SEQ_STYLE")
+	switch seqStyle {
+	case "", seqStyleSequential, seqStyleTimestamp:
+	default:
+		err = &ConfigError{Var: "SEQ_STYLE", Err: fmt.Errorf("%q must be %q or %q", seqStyle, seqStyleSequential, seqStyleTimestamp)}
+		return
+	}
+	c.seqStyle = seqStyle
+
+	// NOTE: MySQL implicitly commits every DDL statement, so wrapping the
+	// pending migrations in a single transaction would not roll anything back
+	// on failure. This mode only makes sense with postgres, which is not
+	// supported by this build.
+	if getenv("SINGLE_TRANSACTION") != "" {
+		err = &ConfigError{Var: "SINGLE_TRANSACTION", Err: errors.New("only supported with postgres: mysql DDL statements auto-commit")}
+		return
+	}
+
+	return
+}
+
+// readRenderConfig reads the settings affecting how the templates are
+// rendered, which are also needed by the render command.
+func (c *Config) readRenderConfig() (err error) {
+	if allow := getenv("TEMPLATE_ENV_ALLOW"); allow != "" {
+		c.templateEnvAllow = splitList(allow)
+	}
+
+	if prefixes := getenv("TEMPLATE_ENV_PREFIX"); prefixes != "" {
+		c.templateEnvPrefixes = splitList(prefixes)
+	}
+
+	if c.templateEnvMax, err = getInt("TEMPLATE_ENV_MAX", c.templateEnvMax); err != nil {
+		return
+	}
+
+	if getenv("NORMALIZE_LINE_ENDINGS") != "" {
+		c.normalizeLineEndings = true
+	}
+
+	if getenv("TEMPLATE_STRICT") != "" {
+		c.templateStrict = true
+	}
+
+	if getenv("STRICT_TEMPLATE_SECRETS") != "" {
+		c.strictSecrets = true
+	}
+
+	return
+}
+
+// sameDir reports whether the paths a and b, resolved if possible, are the
+// same.
+func sameDir(a, b string) bool {
+	resolve := func(path string) string {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		return filepath.Clean(path)
+	}
+	return resolve(a) == resolve(b)
+}
+
+// splitList splits a comma separated list, dropping the empty items.
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getPort(env string, defaultPort uint16) (p uint16, err error) {
+	port, err := getenvOrFile(env)
+	if err != nil {
+		return
+	}
+	if port == "" {
+		p = defaultPort
+		return
+	}
+	parsed, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		err = &ConfigError{Var: env, Err: err}
+		return
+	}
+	p = uint16(parsed)
+	return
+}
+
+func getInt(env string, defaultValue int) (i int, err error) {
+	value, err := getenvOrFile(env)
+	if err != nil {
+		return
+	}
+	if value == "" {
+		i = defaultValue
+		return
+	}
+	i, err = strconv.Atoi(value)
+	if err != nil {
+		err = &ConfigError{Var: env, Err: err}
+	}
+	return
+}
+
+// getenvOrFile returns the value of the given variable or, when it is not set,
+// the content of the file pointed at by the <VAR>_FILE variable.
+func getenvOrFile(env string) (string, error) {
+	if value := getenv(env); value != "" {
+		return value, nil
+	}
+
+	path := getenv(env + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", &ConfigError{Var: env + "_FILE", Err: err}
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func getDuration(env string, defaultValue time.Duration) (d time.Duration, err error) {
+	value, err := getenvOrFile(env)
+	if err != nil {
+		return
+	}
+	if value == "" {
+		d = defaultValue
+		return
+	}
+	d, err = time.ParseDuration(value)
+	if err != nil {
+		err = &ConfigError{Var: env, Err: err}
+	}
+	return
+}
+
+// getSize reads a size in bytes, optionally suffixed with KB, MB or GB as
+// multiples of 1024.
+func getSize(env string, defaultValue int64) (n int64, err error) {
+	value, err := getenvOrFile(env)
+	if err != nil {
+		return
+	}
+	if value == "" {
+		n = defaultValue
+		return
+	}
+
+	unit := int64(1)
+	for suffix, multiple := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if trimmed, ok := strings.CutSuffix(value, suffix); ok {
+			value, unit = strings.TrimSpace(trimmed), multiple
+			break
+		}
+	}
+
+	n, err = strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		err = &ConfigError{Var: env, Err: err}
+		return
+	}
+	n *= unit
+	return
+}
+
+func getBool(env string, defaultValue bool) (b bool, err error) {
+	value, err := getenvOrFile(env)
+	if err != nil {
+		return
+	}
+	if value == "" {
+		b = defaultValue
+		return
+	}
+	b, err = strconv.ParseBool(value)
+	if err != nil {
+		err = &ConfigError{Var: env, Err: err}
+	}
+	return
+}
+
+type logger struct {
+	debug bool
+}
+
+// Printf logs the messages of migrate, tagging the ones about the lock, e.g.
+// lock timeouts, with event=migrate.lock.wait and the others with
+// event=migrate.log.
+//
+// The messages closing each migration are logged as event=migrate.version,
+// with the version and how long it took.
+func (l *logger) Printf(format string, args ...any) {
+	if timing, ok := parseMigrationTiming(format, args); ok {
+		slog.Info("Migration applied", "event", "migrate.version",
+			"version", timing.version, "direction", timing.direction, "duration", timing.duration)
+		return
+	}
+
+	msg := strings.TrimSpace(fmt.Sprintf(format, args...))
+	event := "migrate.log"
+	if strings.Contains(strings.ToLower(msg), "lock") {
+		event = "migrate.lock.wait"
+	}
+	slog.Info("[migrate] "+msg, "event", event)
+}
+
+func (l *logger) Verbose() bool {
+	return l.debug
+}
+
+type migrationTiming struct {
+	version   uint64
+	direction string
+	duration  time.Duration
+}
+
+// parseMigrationTiming extracts the version and duration of a migration from
+// the message migrate logs when done with it, in verbose mode or not.
+func parseMigrationTiming(format string, args []any) (timing migrationTiming, ok bool) {
+	var desc string
+	switch format {
+	case "Finished %v (read %v, ran %v)\n":
+		if len(args) != 3 {
+			return
+		}
+		read, readOK := args[1].(time.Duration)
+		ran, ranOK := args[2].(time.Duration)
+		if !readOK || !ranOK {
+			return
+		}
+		desc, ok = args[0].(string)
+		timing.duration = read + ran
+	case "%v (%v)\n":
+		if len(args) != 2 {
+			return
+		}
+		if timing.duration, ok = args[1].(time.Duration); !ok {
+			return
+		}
+		desc, ok = args[0].(string)
+	}
+	if !ok {
+		return
+	}
+
+	// NOTE: the migration is described as "<version>/<u|d> <identifier>".
+	vers, rest, _ := strings.Cut(desc, "/")
+	dir, _, _ := strings.Cut(rest, " ")
+	version, err := strconv.ParseUint(vers, 10, 64)
+	if err != nil {
+		return timing, false
+	}
+	timing.version = version
+	timing.direction = map[string]string{"u": "up", "d": "down"}[dir]
+	return timing, true
+}
+
+func ls(dir string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Cannot list directory", "err", err)
+		return
+	}
+	for _, entry := range files {
+		slog.Info("Entry", "basedir", dir, "filename", entry.Name())
+	}
+}
+
+// renderTemplates renders the templates in tmplDir into dstDir, returning the
+// paths of the files written.
+func renderTemplates(tmplDir, dstDir string, envs map[string]string, opts renderOptions) ([]string, error) {
+	tmpls, err := template.New("").Funcs(templateFuncs(tmplDir)).ParseGlob(filepath.Join(tmplDir, "*.sql.tmpl"))
+	if err != nil {
+		// NOTE: the error returned by the ParseGlob function is from fmt.Errorf
+		if strings.Contains(err.Error(), "pattern matches no files") {
+			return nil, nil
+		}
+		return nil, &TemplateError{Kind: ErrTemplateParse, Err: err}
+	}
+
+	// NOTE: Templates() iterates over a map, sorting makes the rendering
+	// order, and thus the logs, reproducible.
+	list := tmpls.Templates()
+	slices.SortFunc(list, func(a, b *template.Template) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	paths := make(map[string]string, len(list))
+	outputs := map[string]string{}
+	for _, tmpl := range list {
+		output, err := outputPath(filepath.Join(tmplDir, tmpl.Name()), dstDir, envs, opts.confine)
+		if err != nil {
+			return nil, &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateParse, Err: err}
+		}
+		paths[tmpl.Name()] = output
+
+		if other, ok := outputs[output]; ok {
+			return nil, &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateParse, Err: fmt.Errorf("output %q is also rendered by template %q", output, other)}
+		}
+		outputs[output] = tmpl.Name()
+
+		if opts.existed != nil {
+			if _, err := os.Stat(output); err == nil {
+				opts.existed[filepath.Clean(output)] = true
+			}
+		}
+	}
+
+	var state, next *renderState
+	if opts.stateFile != "" {
+		if state, err = loadRenderState(opts.stateFile); err != nil {
+			return nil, err
+		}
+		next = &renderState{Templates: map[string]renderedTemplate{}}
+	}
+
+	if !opts.overwrite || opts.clean {
+		if opts.generated, err = loadGeneratedFiles(dstDir); err != nil {
+			return nil, err
+		}
+	}
+	if opts.clean {
+		if err := opts.generated.clean(); err != nil {
+			return nil, err
+		}
+	}
+
+	// NOTE: in strict mode the outputs are staged, and only moved into place
+	// once all the templates have been rendered.
+	if opts.strict {
+		if opts.stageDir, err = os.MkdirTemp(dstDir, ".render-"); err != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		defer os.RemoveAll(opts.stageDir)
+	}
+
+	// NOTE: with concurrent renders, the logs of each template are buffered
+	// and flushed in order once all are done.
+	concurrency := max(opts.concurrency, 1)
+	results := make([]renderResult, len(list))
+	jobs := make(chan int)
+	var done atomic.Int64
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				log := slog.Default()
+				if concurrency > 1 {
+					results[i].logs = newLogBuffer()
+					log = slog.New(results[i].logs)
+				}
+
+				tmpl := list[i]
+				results[i].hash, results[i].change, results[i].err = renderOne(tmpl, tmplDir, dstDir, paths[tmpl.Name()], envs, opts, state, log)
+
+				if concurrency > 1 {
+					slog.Debug("Rendering templates", "done", done.Add(1), "total", len(list))
+				}
+			}
+		}()
+	}
+	for i := range list {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if opts.stageDir != "" {
+		if err := commitStaged(list, results, paths, opts.stageDir); err != nil {
+			for i := range results {
+				results[i].logs.flush()
+			}
+			return nil, err
+		}
+	}
+
+	var written []string
+	var errs []error
+	changes := map[string]int{}
+	for i, tmpl := range list {
+		result := results[i]
+		result.logs.flush()
+
+		switch {
+		case result.err != nil:
+			errs = append(errs, fmt.Errorf("failed to render template %q: %w", tmpl.Name(), result.err))
+			continue
+		case result.change == renderSkipped:
+			changes[renderSkipped]++
+			next.Templates[tmpl.Name()] = state.Templates[tmpl.Name()]
+			continue
+		}
+		changes[result.change]++
+
+		output := paths[tmpl.Name()]
+		written = append(written, output)
+
+		if opts.generated != nil {
+			opts.generated.record(tmpl.Name(), output)
+		}
+
+		if next != nil {
+			if err := next.record(tmpl.Name(), result.hash, output); err != nil {
+				errs = append(errs, fmt.Errorf("failed to record template %q: %w", tmpl.Name(), err))
+			}
+		}
+	}
+	slog.Info("Templates rendered",
+		"added", changes[renderAdded], "modified", changes[renderModified],
+		"unchanged", changes[renderUnchanged], "skipped", changes[renderSkipped])
+
+	if opts.generated != nil && len(written) > 0 {
+		if err := opts.generated.save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return written, errors.Join(errs...)
+	}
+
+	if next != nil {
+		if err := next.save(opts.stateFile); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+type renderResult struct {
+	hash   string
+	change string
+	err    error
+	logs   *logBuffer
+}
+
+// renderOne renders tmpl into output, unless it is unchanged since the render
+// recorded in state, if any. It returns the hash of the template, when there
+// is a state, and how the output changed, renderSkipped if not rendered.
+func renderOne(tmpl *template.Template, tmplDir, dstDir, output string, envs map[string]string, opts renderOptions, state *renderState, log *slog.Logger) (hash, change string, err error) {
+	if state != nil {
+		if hash, err = templateHash(filepath.Join(tmplDir, tmpl.Name()), envs, opts); err != nil {
+			return "", "", &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateParse, Err: err}
+		}
+		if state.unchanged(tmpl.Name(), hash, output, log) {
+			log.Info("Template unchanged, not rendering", "event", "template.skipped",
+				"name", tmpl.Name(), "output", output, "reason", "unchanged")
+			return hash, renderSkipped, nil
+		}
+	}
+
+	if dir := filepath.Dir(output); dir != filepath.Clean(dstDir) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", "", &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateExecute, Err: err}
+		}
+	}
+
+	change, err = renderTemplate(tmpl, envs, output, opts, log)
+	return hash, change, err
+}
+
+// templateEnv returns the variables exposed to the templates, restricted to
+// the ones listed in TEMPLATE_ENV_ALLOW or starting with one of the
+// TEMPLATE_ENV_PREFIX, when either is set. More variables than
+// TEMPLATE_ENV_MAX are reported, as every template is given all of them.
+func (c Config) templateEnv() map[string]string {
+	envs := envToMap()
+	if c.templateEnvAllow != nil || c.templateEnvPrefixes != nil {
+		allowed := map[string]string{}
+		for name, value := range envs {
+			if slices.Contains(c.templateEnvAllow, name) || slices.ContainsFunc(c.templateEnvPrefixes, func(prefix string) bool {
+				return strings.HasPrefix(name, prefix)
+			}) {
+				allowed[name] = value
+			}
+		}
+		envs = allowed
+	}
+
+	if c.templateEnvMax > 0 && len(envs) > c.templateEnvMax {
+		slog.Warn("Too many variables exposed to the templates, restrict them with TEMPLATE_ENV_ALLOW or TEMPLATE_ENV_PREFIX",
+			"vars", len(envs), "max", c.templateEnvMax)
+	}
+	return envs
+}
+
+func envToMap() map[string]string {
+	result := map[string]string{}
+	for k, v := range fileValues {
+		result[k] = v
+	}
+	for _, v := range os.Environ() {
+		split := strings.SplitN(v, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		result[split[0]] = split[1]
+	}
+
+	return result
+}
+
+// renderTemplate renders tmpl against envs into the file at filePath,
+// returning how its content changed.
+func renderTemplate(tmpl *template.Template, envs map[string]string, filePath string, opts renderOptions, log *slog.Logger) (string, error) {
+	if tmpl == nil {
+		return "", fmt.Errorf("template is nil")
+	}
+
+	output, err := renderOutput(tmpl, envs, opts, log)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.generated != nil && !opts.overwrite {
+		if err := opts.generated.allows(tmpl.Name(), filePath, output); err != nil {
+			return "", &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateExecute, Err: err}
+		}
+	}
+
+	previous, readErr := os.ReadFile(filePath)
+	if readErr != nil && !errors.Is(readErr, os.ErrNotExist) {
+		return "", &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateExecute, Err: readErr}
+	}
+
+	writePath := filePath
+	if opts.stageDir != "" {
+		writePath = stagedPath(opts.stageDir, filePath)
+	}
+	if err := os.WriteFile(writePath, output, 0o666); err != nil {
+		return "", &TemplateError{Name: tmpl.Name(), Kind: ErrTemplateExecute, Err: fmt.Errorf("failed to create file: %w", err)}
+	}
+
+	change := logRenderChange(log, filePath, previous, readErr == nil, output, opts.secrets)
+	log.Info("Template rendered", "event", "template.rendered",
+		"name", tmpl.Name(), "output", filePath, "bytes", len(output), "change", change)
+	return change, nil
+}
+
+// renderOutput renders tmpl against envs, returning the content to be
+// written.
+func renderOutput(tmpl *template.Template, envs map[string]string, opts renderOptions, log *slog.Logger) ([]byte, error) {
+	tmplName := tmpl.Name()
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, envs); err != nil {
+		return nil, &TemplateError{Name: tmplName, Kind: ErrTemplateExecute, Err: err}
+	}
+
+	// NOTE: templates authored on Windows may start with a UTF-8 BOM, which
+	// would end up inside the first statement.
+	output := bytes.TrimPrefix(buf.Bytes(), utf8BOM)
+	if opts.normalizeLineEndings {
+		output = bytes.ReplaceAll(output, []byte("\r\n"), []byte("\n"))
+	}
+
+	if leaked := leakedSecrets(output, opts.secrets); len(leaked) > 0 {
+		if opts.strictSecrets {
+			return nil, &TemplateError{Name: tmplName, Kind: ErrTemplateExecute, Err: fmt.Errorf("output contains the value of %s", strings.Join(leaked, ", "))}
+		}
+		log.Warn("Template output contains sensitive values", "template", tmplName, "vars", leaked)
+	}
+
+	return output, nil
+}
+
+// exit returns the given exit code. When HOLD_OPEN is set, the process is
+// first kept alive until signalled, so that it can be inspected.
+func exit(cfg Config, code int) int {
+	if cfg.holdOpen {
+		slog.Info("Holding the process open until signalled", "exitCode", code)
+		sig := waitForSignal()
+		slog.Info("Received signal", "signal", sig)
+	}
+	return code
+}
+
+func waitForSignal() os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	return <-ch
+}
+
+// sleepOrSignal waits for d, returning early with the signal when a
+// termination one is received, nil otherwise.
+func sleepOrSignal(d time.Duration) os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case sig := <-ch:
+		return sig
+	case <-timer.C:
+		return nil
+	}
+}
+
+func outputFileName(tmplName string) string {
+	return strings.TrimSuffix(tmplName, ".tmpl")
+}
+
+// retryFor calls f until it succeeds, waiting delay between the attempts, for
+// up to timeout or until ctx is done. On timeout, the error of the last
+// attempt is returned along with the timeout one, or along with the error of
+// ctx once done.
+//
+// The context given to f is done on timeout. An attempt still running then is
+// given up on: its result is not returned, and passed to release, when set,
+// if it succeeds after all.
+func retryFor[T any](ctx context.Context, f func(context.Context) (T, error), release func(T), delay, timeout time.Duration) (T, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+
+	var lastErr error
+	stopped := func(running <-chan result) (T, error) {
+		if running != nil && release != nil {
+			go func() {
+				if r := <-running; r.err == nil {
+					release(r.value)
+				}
+			}()
+		}
+
+		var zero T
+		if err := parent.Err(); err != nil {
+			return zero, errors.Join(err, lastErr)
+		}
+		return zero, errors.Join(errors.New("the operation exceeded the timeout"), lastErr)
+	}
+
+	for {
+		// NOTE: buffered, so that an attempt given up on does not block.
+		done := make(chan result, 1)
+		go func() {
+			value, err := f(ctx)
+			done <- result{value, err}
+		}()
+
+		select {
+		case r := <-done:
+			if r.err == nil {
+				return r.value, nil
+			}
+			lastErr = r.err
+		case <-ctx.Done():
+			return stopped(done)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return stopped(nil)
+		}
+	}
+}
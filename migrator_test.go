@@ -0,0 +1,188 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setRequiredEnv sets the variables ConfigFromEnv requires.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("DB_USER", "app")
+	t.Setenv("DB_PASS", "secret")
+	t.Setenv("DB_HOST", "db")
+	t.Setenv("DB_NAME", "app")
+}
+
+func TestConfigRejectsMigrationsAsTemplates(t *testing.T) {
+	dir := t.TempDir()
+	migrations := filepath.Join(dir, "migrations")
+	if err := os.Mkdir(migrations, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "templates")
+	if err := os.Symlink(migrations, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		templates string
+	}{
+		{"same path", migrations},
+		{"trailing slash", migrations + "/"},
+		{"unclean path", filepath.Join(dir, "migrations", "..", "migrations") + "/."},
+		{"symlink", link},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("MIGRATIONS", migrations)
+			t.Setenv("TEMPLATES", tt.templates)
+
+			_, err := ConfigFromEnv()
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || configErr.Var != "TEMPLATES" {
+				t.Errorf("ConfigFromEnv() = %v, want an invalid TEMPLATES", err)
+			}
+		})
+	}
+}
+
+func TestConfigAcceptsSeparateTemplates(t *testing.T) {
+	dir := t.TempDir()
+
+	setRequiredEnv(t)
+	t.Setenv("MIGRATIONS", filepath.Join(dir, "migrations"))
+	t.Setenv("TEMPLATES", filepath.Join(dir, "templates"))
+
+	if _, err := ConfigFromEnv(); err != nil {
+		t.Errorf("ConfigFromEnv() = %v", err)
+	}
+}
+
+func TestGettersReadFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(env, value string) {
+		path := filepath.Join(dir, env)
+		if err := os.WriteFile(path, []byte(value+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(env+"_FILE", path)
+	}
+	write("TEST_DURATION", "2s")
+	write("TEST_SIZE", "3KB")
+	write("TEST_BOOL", "true")
+
+	if d, err := getDuration("TEST_DURATION", 0); err != nil || d != 2*time.Second {
+		t.Errorf("getDuration() = %v, %v, want 2s", d, err)
+	}
+	if n, err := getSize("TEST_SIZE", 0); err != nil || n != 3<<10 {
+		t.Errorf("getSize() = %d, %v, want %d", n, err, 3<<10)
+	}
+	if b, err := getBool("TEST_BOOL", false); err != nil || !b {
+		t.Errorf("getBool() = %t, %v, want true", b, err)
+	}
+}
+
+func TestCheckLeavesMigrationsUntouched(t *testing.T) {
+	dir := t.TempDir()
+	migrations, templates := filepath.Join(dir, "migrations"), filepath.Join(dir, "templates")
+	for path, content := range map[string]string{
+		filepath.Join(migrations, "1_init.up.sql"):      "CREATE TABLE a (id INT);",
+		filepath.Join(templates, "2_users.up.sql.tmpl"): "CREATE TABLE users (id INT);",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := NewConfig(
+		WithDatabase("app", "secret", "127.0.0.1", 1, "app"),
+		WithMigrations(migrations),
+		WithTemplates(templates),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.check = true
+
+	// NOTE: nothing listens on the port, the version cannot be read.
+	err = (&target{cfg: cfg}).migrate(context.Background(), false)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Stage != stageConnect {
+		t.Errorf("migrate() = %v, want a connect error", err)
+	}
+
+	entries, err := os.ReadDir(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "1_init.up.sql" {
+		t.Errorf("migrations = %v, want only 1_init.up.sql", entries)
+	}
+}
+
+func TestConfigRejectsNegativeRetries(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("MIGRATE_RETRIES", "-1")
+
+	_, err := ConfigFromEnv()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Var != "MIGRATE_RETRIES" {
+		t.Errorf("ConfigFromEnv() = %v, want an invalid MIGRATE_RETRIES", err)
+	}
+}
+
+func TestRetryForReleasesAbandonedResult(t *testing.T) {
+	unblock := make(chan struct{})
+	released := make(chan int, 1)
+
+	_, err := retryFor(context.Background(), func(context.Context) (int, error) {
+		<-unblock
+		return 42, nil
+	}, func(v int) {
+		released <- v
+	}, time.Millisecond, 10*time.Millisecond)
+	if err == nil || errors.Is(err, context.Canceled) {
+		t.Fatalf("retryFor() = %v, want a timeout", err)
+	}
+
+	close(unblock)
+	select {
+	case v := <-released:
+		if v != 42 {
+			t.Errorf("released %d, want 42", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("the result of the abandoned attempt was not released")
+	}
+}
+
+func TestRetryForReportsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempted := errors.New("unreachable")
+
+	// NOTE: cancelled while waiting for the next attempt.
+	called := make(chan struct{}, 1)
+	go func() {
+		<-called
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := retryFor(ctx, func(context.Context) (struct{}, error) {
+		called <- struct{}{}
+		return struct{}{}, attempted
+	}, nil, time.Minute, time.Hour)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, attempted) {
+		t.Errorf("retryFor() = %v, want the cancellation and the last error", err)
+	}
+}
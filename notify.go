@@ -0,0 +1,188 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	defaultNotifyTimeout = 5 * time.Second
+	notifyRetries        = 2
+	notifyBackoff        = 500 * time.Millisecond
+)
+
+// newNotifyClient returns the client posting to the webhooks, trusting the CAs
+// in caFile on top of the system ones, when set.
+func newNotifyClient(caFile string, insecure bool, timeout time.Duration) (*http.Client, error) {
+	if caFile == "" && !insecure {
+		return &http.Client{Timeout: timeout}, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// Events the NOTIFY_TARGETS are filtered on.
+const (
+	notifyOnSuccess = "success"
+	notifyOnFailure = "failure"
+)
+
+// notifyTarget is a webhook of the NOTIFY_TARGETS, posted the runs whose
+// event is listed in On, or all of them when empty. NOTIFY_URL is a target
+// with no filter.
+type notifyTarget struct {
+	URL string   `json:"url"`
+	On  []string `json:"on"`
+}
+
+// parseNotifyTargets parses the NOTIFY_TARGETS, a JSON list of targets, e.g.
+// [{"url": "https://hooks.example.com/migrations", "on": ["success"]}].
+func parseNotifyTargets(value string) ([]notifyTarget, error) {
+	var targets []notifyTarget
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&targets); err != nil {
+		return nil, err
+	}
+
+	for i, target := range targets {
+		// NOTE: the error of the parser embeds the URL, with its token, only
+		// the cause is kept.
+		if _, err := url.ParseRequestURI(target.URL); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i, errors.Unwrap(err))
+		}
+		for _, event := range target.On {
+			if event != notifyOnSuccess && event != notifyOnFailure {
+				return nil, fmt.Errorf("target %d: unknown event %q, expected %s or %s", i, event, notifyOnSuccess, notifyOnFailure)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// accepts reports whether the run with the given outcome is to be posted to
+// the target.
+func (n notifyTarget) accepts(outcome string) bool {
+	event := notifyOnSuccess
+	if outcome == outcomeFailed {
+		event = notifyOnFailure
+	}
+	return len(n.On) == 0 || slices.Contains(n.On, event)
+}
+
+// notify posts the record of a run to the NOTIFY_URL and the matching
+// NOTIFY_TARGETS webhooks, concurrently, each retried with an exponential
+// backoff on network errors and 5xx responses.
+func (t *target) notify(rec runRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	var targets []notifyTarget
+	for _, target := range t.cfg.notifyTargets {
+		if target.accepts(rec.Outcome) {
+			targets = append(targets, target)
+		}
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = t.postWithRetries(target.URL, body)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// postWithRetries posts body to the webhook at rawURL, retrying it.
+func (t *target) postWithRetries(rawURL string, body []byte) error {
+	// NOTE: webhook URLs often carry a token in their path, only the host is
+	// logged.
+	var host string
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := t.postNotification(rawURL, body)
+		if err == nil {
+			slog.Info("Notification sent", "host", host, "attempts", attempt+1)
+			return nil
+		}
+		if !retry || attempt >= notifyRetries {
+			return fmt.Errorf("to %s after %d attempts: %w", host, attempt+1, err)
+		}
+
+		backoff := withJitter(notifyBackoff << attempt)
+		slog.Debug("Failed to send the notification, retrying", "host", host, "err", err, "attempt", attempt+1, "backoff", backoff)
+		sleep(context.Background(), backoff)
+	}
+}
+
+// postNotification posts body to the webhook at rawURL, reporting whether a
+// failure is worth retrying. The error does not include rawURL.
+func (t *target) postNotification(rawURL string, body []byte) (retry bool, err error) {
+	resp, err := t.cfg.notifyClient.Post(rawURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// NOTE: the error of the client embeds the URL, with its token,
+		// only the cause is kept.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
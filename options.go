@@ -0,0 +1,111 @@
+package migrator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+// Option sets a setting of the Config built by NewConfig.
+type Option func(*Config)
+
+// NewConfig returns the Config with the defaults of ConfigFromEnv, changed by
+// opts. The settings required by ConfigFromEnv are required here too, and
+// reported by a ConfigError named after their variable.
+func NewConfig(opts ...Option) (Config, error) {
+	c := defaultConfig()
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	for env, value := range map[string]string{
+		"DB_USER": c.dbUser,
+		"DB_PASS": c.dbPass,
+		"DB_HOST": c.dbHost,
+		"DB_NAME": c.dbName,
+	} {
+		if value == "" {
+			return Config{}, &ConfigError{Var: env}
+		}
+	}
+
+	if sameDir(c.migrations, c.templates) {
+		return Config{}, &ConfigError{Var: "TEMPLATES", Err: fmt.Errorf("%q is also the MIGRATIONS directory, where the templates would be taken for migrations", c.templates)}
+	}
+
+	return c, nil
+}
+
+// defaultConfig returns the Config with the values of the settings that are
+// not set.
+func defaultConfig() Config {
+	return Config{
+		dbPort:            3306,
+		dbDriver:          dbDriverMySQL,
+		versionCacheTTL:   time.Second,
+		migrations:        "/migrations",
+		templates:         "/templates",
+		port:              8080,
+		adminHost:         "127.0.0.1",
+		adminBindFatal:    true,
+		renderConcurrency: 1,
+		maxFileSize:       defaultMaxFileSize,
+		templateEnvMax:    defaultTemplateEnvMax,
+		migrateMode:       migrateModeUp,
+		baselineVersion:   database.NilVersion,
+		appName:           "migrator",
+	}
+}
+
+// WithDatabase sets the database to migrate, as DB_USER, DB_PASS, DB_HOST,
+// DB_PORT and DB_NAME do.
+func WithDatabase(user, password, host string, port uint16, name string) Option {
+	return func(c *Config) {
+		c.dbUser, c.dbPass, c.dbHost, c.dbPort, c.dbName = user, password, host, port, name
+	}
+}
+
+// WithMigrations sets the directory of the migrations, as MIGRATIONS does.
+func WithMigrations(dir string) Option {
+	return func(c *Config) {
+		c.migrations = dir
+	}
+}
+
+// WithTemplates sets the directory of the templates, as TEMPLATES does.
+func WithTemplates(dir string) Option {
+	return func(c *Config) {
+		c.templates = dir
+	}
+}
+
+// WithPort sets the port the version is served on, as PORT does.
+func WithPort(port uint16) Option {
+	return func(c *Config) {
+		c.port = port
+	}
+}
+
+// WithAdmin sets the address the admin endpoints are served on, as
+// ADMIN_HOST and ADMIN_PORT do.
+func WithAdmin(host string, port uint16) Option {
+	return func(c *Config) {
+		c.adminHost, c.adminPort = host, port
+	}
+}
+
+// WithAppName sets the program name the connections to the databases are
+// labelled with, which is also recorded in the history, as APP_NAME does.
+func WithAppName(name string) Option {
+	return func(c *Config) {
+		c.appName = name
+	}
+}
+
+// WithDebug enables the debug logs, as DEBUG does.
+func WithDebug() Option {
+	return func(c *Config) {
+		c.debug, c.logPlan, c.logSource = true, true, true
+	}
+}
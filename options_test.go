@@ -0,0 +1,44 @@
+package migrator
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewConfig(
+		WithDatabase("app", "secret", "db", 3307, "app"),
+		WithMigrations(filepath.Join(dir, "migrations")),
+		WithTemplates(filepath.Join(dir, "templates")),
+	)
+	if err != nil {
+		t.Fatalf("NewConfig() = %v", err)
+	}
+	if c.dbPort != 3307 || c.port != 8080 || c.adminHost != "127.0.0.1" {
+		t.Errorf("NewConfig() = port %d, %d and admin host %q, want 3307, 8080 and 127.0.0.1", c.dbPort, c.port, c.adminHost)
+	}
+}
+
+func TestNewConfigRequiresDatabase(t *testing.T) {
+	_, err := NewConfig(WithDatabase("app", "", "db", 3306, "app"))
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Var != "DB_PASS" {
+		t.Errorf("NewConfig() = %v, want a missing DB_PASS", err)
+	}
+}
+
+func TestDefaultConfigMatchesEnv(t *testing.T) {
+	setRequiredEnv(t)
+
+	c, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() = %v", err)
+	}
+	d := defaultConfig()
+	if c.port != d.port || c.migrations != d.migrations || c.templates != d.templates || c.baselineVersion != d.baselineVersion {
+		t.Errorf("ConfigFromEnv() defaults differ from defaultConfig()")
+	}
+}
@@ -0,0 +1,169 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+	"gopkg.in/yaml.v3"
+)
+
+// loadOrderManifest reads the manifest at path, a YAML list of versions in
+// the order they are to be applied, e.g. [7, 6]. Being YAML, a JSON list is
+// accepted too.
+func loadOrderManifest(path string) ([]uint, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order manifest: %w", err)
+	}
+
+	var order []uint
+	if err := yaml.Unmarshal(content, &order); err != nil {
+		return nil, fmt.Errorf("failed to parse order manifest %q: %w", path, err)
+	}
+	return order, nil
+}
+
+// reorderPending returns the pending versions with the ones listed in order
+// rearranged among the positions they take, e.g. [5 7 6 8] for the pending
+// [5 6 7 8] and the order [7 6].
+//
+// The listed versions up to current, the version of the database, have been
+// applied already, e.g. by a previous run with the same manifest, and are left
+// out. As the pending versions are all above current, the order never applies
+// a version below an applied one. Listing a version that is neither applied
+// nor pending is an error.
+func reorderPending(pending, order []uint, current *uint) ([]uint, error) {
+	var positions []int
+	var reordered []uint
+	for _, v := range order {
+		i := slices.Index(pending, v)
+		if i < 0 {
+			if current != nil && v <= *current {
+				slog.Debug("Version in the order manifest already applied", "version", v)
+				continue
+			}
+			return nil, fmt.Errorf("version %d in the order manifest is not in the migrations", v)
+		}
+		if slices.Contains(positions, i) {
+			return nil, fmt.Errorf("version %d listed more than once in the order manifest", v)
+		}
+		positions = append(positions, i)
+		reordered = append(reordered, v)
+	}
+	slices.Sort(positions)
+
+	ordered := slices.Clone(pending)
+	for i, v := range reordered {
+		ordered[positions[i]] = v
+	}
+	return ordered, nil
+}
+
+// applyOrdered applies the pending migrations up to the last one reordered by
+// the manifest, in the resulting order. The ones before the first reordered
+// migration are applied by migrate, the others one by one through the driver
+// of c, holding lock when set, recording the highest version applied so
+// far. The versions listed in skip are marked as applied without running them.
+func applyOrdered(ctx context.Context, m *migrate.Migrate, c Config, lock *namedLock, sourceURL string, order, skip []uint, retries int) error {
+	current, _, err := currentVersion(m)
+	if err != nil {
+		return err
+	}
+	pending, err := pendingVersions(m, sourceURL)
+	if err != nil {
+		return err
+	}
+	ordered, err := reorderPending(pending, order, current)
+	if err != nil {
+		return err
+	}
+
+	first, last := -1, -1
+	for i := range ordered {
+		if ordered[i] != pending[i] {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	if first > 0 {
+		limit := pending[first-1]
+		if len(skip) > 0 {
+			if err := skipVersions(ctx, m, sourceURL, skip, retries, &limit); err != nil {
+				return err
+			}
+		}
+		if err := upWithRetries(ctx, m, sourceURL, retries, migrateModeUp, &limit); err != nil && err != migrate.ErrNoChange {
+			return err
+		}
+	}
+
+	return applySegment(ctx, c, lock, sourceURL, ordered[first:last+1], skip)
+}
+
+// applySegment applies the given versions in order through the driver of c,
+// holding the migration lock, stopping before the next one once ctx is
+// done.
+func applySegment(ctx context.Context, c Config, lock *namedLock, sourceURL string, versions, skip []uint) error {
+	driver, err := c.openDriver(lock)
+	if err != nil {
+		return err
+	}
+	defer driver.Close()
+
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	if err := driver.Lock(); err != nil {
+		return err
+	}
+	defer driver.Unlock()
+
+	// NOTE: the version table holds a single version, the highest applied
+	// so far, so that none of the applied migrations is taken for pending.
+	var top uint
+	for _, v := range versions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		top = max(top, v)
+
+		if slices.Contains(skip, v) {
+			slog.Warn("Skipping migration, marking it as applied without running it", "version", v)
+		} else {
+			body, _, err := src.ReadUp(v)
+			if err != nil {
+				return fmt.Errorf("failed to read version %d: %w", v, err)
+			}
+
+			slog.Warn("Applying migration out of order", "version", v, "recordedVersion", top)
+			if err := driver.SetVersion(int(top), true); err != nil {
+				body.Close()
+				return err
+			}
+			err = driver.Run(body)
+			body.Close()
+			if err != nil {
+				return fmt.Errorf("failed to apply version %d: %w", v, err)
+			}
+		}
+
+		if err := driver.SetVersion(int(top), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package migrator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// renderState is the content of the RENDER_STATE_FILE, recording what each
+// template was last rendered from and into.
+type renderState struct {
+	Templates map[string]renderedTemplate `json:"templates"`
+}
+
+type renderedTemplate struct {
+	// Hash covers the template source and what it is rendered against.
+	Hash       string `json:"hash"`
+	Output     string `json:"output"`
+	OutputHash string `json:"outputHash"`
+}
+
+func loadRenderState(path string) (*renderState, error) {
+	state := &renderState{Templates: map[string]renderedTemplate{}}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read render state: %w", err)
+	}
+
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("failed to parse render state %q: %w", path, err)
+	}
+	if state.Templates == nil {
+		state.Templates = map[string]renderedTemplate{}
+	}
+
+	return state, nil
+}
+
+// save atomically replaces the file at path with the state.
+func (s *renderState) save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write render state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write render state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write render state: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// unchanged reports whether the template name was last rendered with the
+// given hash into output, and the file has not been modified since.
+func (s *renderState) unchanged(name, hash, output string, log *slog.Logger) bool {
+	entry, ok := s.Templates[name]
+	if !ok || entry.Hash != hash || entry.Output != output {
+		return false
+	}
+
+	outputHash, err := hashFile(output)
+	if err != nil {
+		return false
+	}
+	if outputHash != entry.OutputHash {
+		log.Warn("Rendered file modified since the last render, rendering again", "template", name, "output", output)
+		return false
+	}
+
+	return true
+}
+
+func (s *renderState) record(name, hash, output string) error {
+	outputHash, err := hashFile(output)
+	if err != nil {
+		return err
+	}
+	s.Templates[name] = renderedTemplate{
+		Hash:       hash,
+		Output:     output,
+		OutputHash: outputHash,
+	}
+	return nil
+}
+
+// templateHash hashes the source of the template at path together with the
+// files it includes, the variables and the options it is rendered with.
+//
+// NOTE: only the files included with a literal path are hashed, changes to
+// the ones included with a computed path go unnoticed.
+func templateHash(path string, envs map[string]string, opts renderOptions) (string, error) {
+	h := sha256.New()
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	h.Write(source)
+
+	for _, call := range includeCall.FindAllSubmatch(source, -1) {
+		included, err := includePath(filepath.Dir(path), string(call[1]))
+		if err != nil {
+			return "", err
+		}
+		content, err := os.ReadFile(included)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\x00include=%s\x00", call[1])
+		h.Write(content)
+	}
+
+	keys := make([]string, 0, len(envs))
+	for k := range envs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "\x00%s=%s", k, envs[k])
+	}
+	fmt.Fprintf(h, "\x00normalizeLineEndings=%t", opts.normalizeLineEndings)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// generatedManifest is the file, in the migrations directory, recording the
+// outputs of the templates, so that other files are never overwritten.
+const generatedManifest = ".migrator-generated.json"
+
+// generatedFiles maps the outputs, relative to the migrations directory, to
+// the template rendering them.
+type generatedFiles struct {
+	dir   string
+	Files map[string]string `json:"files"`
+}
+
+func loadGeneratedFiles(dir string) (*generatedFiles, error) {
+	g := &generatedFiles{dir: dir, Files: map[string]string{}}
+
+	content, err := os.ReadFile(filepath.Join(dir, generatedManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generated files: %w", err)
+	}
+
+	if err := json.Unmarshal(content, g); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", generatedManifest, err)
+	}
+	if g.Files == nil {
+		g.Files = map[string]string{}
+	}
+
+	return g, nil
+}
+
+func (g *generatedFiles) key(output string) string {
+	if rel, err := filepath.Rel(g.dir, output); err == nil {
+		return rel
+	}
+	return output
+}
+
+// allows reports an error unless output is missing, was rendered from the
+// template name, or already has the given content.
+func (g *generatedFiles) allows(name, output string, content []byte) error {
+	existing, err := os.ReadFile(output)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if g.Files[g.key(output)] == name || bytes.Equal(existing, content) {
+		return nil
+	}
+	return fmt.Errorf("refusing to overwrite %q, not rendered from template %q: set RENDER_OVERWRITE=true to overwrite it", output, name)
+}
+
+func (g *generatedFiles) record(name, output string) {
+	g.Files[g.key(output)] = name
+}
+
+// clean removes the .sql files recorded as rendered, so that the outputs of
+// templates since removed, or rendered under other names, do not linger.
+func (g *generatedFiles) clean() error {
+	names := make([]string, 0, len(g.Files))
+	for name := range g.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if filepath.Ext(name) != ".sql" || !filepath.IsLocal(name) {
+			continue
+		}
+
+		path := filepath.Join(g.dir, name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove rendered file: %w", err)
+		} else if err == nil {
+			slog.Info("Removed previously rendered file", "file", path, "template", g.Files[name])
+		}
+		delete(g.Files, name)
+	}
+
+	return g.save()
+}
+
+// rollbackRender removes the files written by a render that did not exist
+// before it, as listed in existing, along with their entries in the generated
+// files manifest of dir, so that a retry starts from the same files. The
+// files that existed are left in place, as they may have been applied.
+func rollbackRender(dir string, written []string, existing map[string]bool) {
+	generated, err := loadGeneratedFiles(dir)
+	if err != nil {
+		slog.Warn("Failed to read the generated files, not updating them", "err", err)
+	}
+
+	recorded := false
+	for _, path := range written {
+		if existing[filepath.Clean(path)] {
+			slog.Debug("Keeping the rendered file, which existed before", "file", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to remove the rendered file", "file", path, "err", err)
+			continue
+		}
+		slog.Info("Removed the file rendered by the failed run", "file", path)
+
+		if generated != nil {
+			if _, ok := generated.Files[generated.key(path)]; ok {
+				delete(generated.Files, generated.key(path))
+				recorded = true
+			}
+		}
+	}
+
+	if recorded {
+		if err := generated.save(); err != nil {
+			slog.Warn("Failed to update the generated files", "err", err)
+		}
+	}
+}
+
+func (g *generatedFiles) save() error {
+	content, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(g.dir, generatedManifest), content, 0o666); err != nil {
+		return fmt.Errorf("failed to write generated files: %w", err)
+	}
+	return nil
+}
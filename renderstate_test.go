@@ -0,0 +1,47 @@
+package migrator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackRenderKeepsExistingOutputs(t *testing.T) {
+	dir := t.TempDir()
+	migrations, seeds, templates := filepath.Join(dir, "migrations"), filepath.Join(dir, "seeds"), filepath.Join(dir, "templates")
+	for path, content := range map[string]string{
+		filepath.Join(seeds, "2_seed.up.sql"):           "INSERT INTO users VALUES (0);",
+		filepath.Join(templates, "2_seed.up.sql.tmpl"):  "-- output-dir: " + seeds + "\nINSERT INTO users VALUES (1);",
+		filepath.Join(templates, "3_users.up.sql.tmpl"): "CREATE TABLE users (id INT);",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(migrations, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := renderOptions{overwrite: true, existed: map[string]bool{}}
+	written, err := renderTemplates(templates, migrations, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 {
+		t.Fatalf("renderTemplates() wrote %v, want 2 files", written)
+	}
+
+	rollbackRender(migrations, written, opts.existed)
+
+	if _, err := os.Stat(filepath.Join(seeds, "2_seed.up.sql")); err != nil {
+		t.Errorf("the output existing outside of the migrations was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(migrations, "3_users.up.sql")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the new output was not removed: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+var defaultVerifyTimeout = defaultPingTimeout * 5
+
+// expectedSchema maps the tables expected in the database to the columns
+// expected in each, as read from the SCHEMA_VERIFY file.
+type expectedSchema map[string][]string
+
+func loadExpectedSchema(path string) (expectedSchema, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expected schema: %w", err)
+	}
+
+	var expected expectedSchema
+	if err := json.Unmarshal(content, &expected); err != nil {
+		return nil, fmt.Errorf("failed to parse expected schema %q: %w", path, err)
+	}
+	return expected, nil
+}
+
+// verifySchema checks, without modifying anything, that the tables and
+// columns of the SCHEMA_VERIFY file exist in the database. Otherwise, it
+// returns an *ExitError with exit code 8, listing what is missing. Tables and
+// columns not listed are not reported.
+func (t *target) verifySchema(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultVerifyTimeout)
+	defer cancel()
+
+	actual, err := schemaColumns(ctx, t.db)
+	if err != nil {
+		slog.Error("Failed to read the database schema", "err", err)
+		return &ExitError{Stage: stageVerify, Code: 2, Err: err}
+	}
+
+	tables := make([]string, 0, len(t.cfg.schemaVerify))
+	for table := range t.cfg.schemaVerify {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+
+	var missing []string
+	for _, table := range tables {
+		columns, ok := actual[table]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("table %s", table))
+			continue
+		}
+		for _, column := range t.cfg.schemaVerify[table] {
+			if !columns[column] {
+				missing = append(missing, fmt.Sprintf("column %s.%s", table, column))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		slog.Error("Database schema does not match the expected one", "missing", missing)
+		return &ExitError{Stage: stageVerify, Code: 8, Err: fmt.Errorf("missing from the database schema: %s", strings.Join(missing, ", "))}
+	}
+
+	slog.Info("Database schema matches the expected one", "tables", len(tables))
+	return nil
+}
+
+// schemaColumns returns the columns of each table of the database db is
+// connected to.
+func schemaColumns(ctx context.Context, db *sql.DB) (map[string]map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		if columns[table] == nil {
+			columns[table] = map[string]bool{}
+		}
+		columns[table][column] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,134 @@
+package migrator
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tokens are the DB_AUTH=iam tokens fetched so far, masked along with the
+// passwords, as they only become known while running.
+var tokens secretSet
+
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// add adds the secret, along with its URL-escaped forms.
+func (s *secretSet) add(secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = appendSecret(s.values, secret)
+}
+
+func (s *secretSet) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values
+}
+
+// appendSecret appends the secret to secrets, along with its URL-escaped
+// forms, as found in the DSNs, unless already there or shorter than
+// minSecretLength, as it would then mask unrelated text.
+func appendSecret(secrets []string, secret string) []string {
+	if len(secret) < minSecretLength {
+		return secrets
+	}
+	for _, s := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+		if !slices.Contains(secrets, s) {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// passwords returns the database passwords of all the targets, along with
+// their URL-escaped forms.
+func (c Config) passwords() []string {
+	var passwords []string
+	for _, t := range c.targets() {
+		passwords = appendSecret(passwords, t.dbPass)
+		passwords = appendSecret(passwords, t.ddlPass)
+		if t.urlConfig != nil {
+			passwords = appendSecret(passwords, t.urlConfig.Passwd)
+		}
+		if _, dsn, ok := strings.Cut(t.readURL, "://"); ok {
+			if mc, err := mysql.ParseDSN(dsn); err == nil {
+				passwords = appendSecret(passwords, mc.Passwd)
+			}
+		}
+	}
+
+	// NOTE: the longest first, so that a password containing another is
+	// masked as a whole.
+	slices.SortFunc(passwords, func(a, b string) int { return len(b) - len(a) })
+	return passwords
+}
+
+// scrub replaces the passwords and the tokens found in s with ***.
+func scrub(s string, passwords []string) string {
+	// NOTE: the tokens first, as they are usually much longer than the
+	// passwords, which could then mask only part of a token.
+	for _, token := range tokens.list() {
+		s = strings.ReplaceAll(s, token, "***")
+	}
+	for _, password := range passwords {
+		s = strings.ReplaceAll(s, password, "***")
+	}
+	return s
+}
+
+// scrubHandler is a slog.Handler masking the passwords in the messages and
+// in the string and error attributes, e.g. the DSNs that the errors of the
+// drivers may embed, before passing the records on.
+type scrubHandler struct {
+	slog.Handler
+	passwords []string
+}
+
+func (h scrubHandler) Handle(ctx context.Context, r slog.Record) error {
+	scrubbed := slog.NewRecord(r.Time, r.Level, scrub(r.Message, h.passwords), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		scrubbed.AddAttrs(h.scrubAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, scrubbed)
+}
+
+func (h scrubHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scrubbed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		scrubbed[i] = h.scrubAttr(a)
+	}
+	return scrubHandler{Handler: h.Handler.WithAttrs(scrubbed), passwords: h.passwords}
+}
+
+func (h scrubHandler) WithGroup(name string) slog.Handler {
+	return scrubHandler{Handler: h.Handler.WithGroup(name), passwords: h.passwords}
+}
+
+func (h scrubHandler) scrubAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, scrub(v.String(), h.passwords))
+	case slog.KindGroup:
+		attrs := v.Group()
+		scrubbed := make([]any, len(attrs))
+		for i, attr := range attrs {
+			scrubbed[i] = h.scrubAttr(attr)
+		}
+		return slog.Group(a.Key, scrubbed...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok && err != nil {
+			return slog.String(a.Key, scrub(err.Error(), h.passwords))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
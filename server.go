@@ -0,0 +1,857 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const (
+	fieldStyleSnakeCase = "snake_case"
+	fieldStyleCamelCase = "camelCase"
+)
+
+var (
+	defaultPingTimeout     = 2 * time.Second
+	defaultShutdownTimeout = 10 * time.Second
+	defaultWaitTimeout     = 30 * time.Second
+	maxWaitTimeout         = 10 * time.Minute
+	defaultWaitInterval    = 1 * time.Second
+)
+
+// target is a migrated database, name is empty unless configured from the
+// DATABASES list.
+type target struct {
+	name string
+	cfg  Config
+	m    *migrate.Migrate
+	db   *sql.DB
+
+	// vm reads the version from the DB_READ_URL replica, or with the
+	// regular credentials when DDL_DB_USER is set; m is used otherwise.
+	// It is replaced when its connection is lost, so vmMu is held while in
+	// use.
+	vmMu sync.RWMutex
+	vm   *migrate.Migrate
+
+	// tmpDir, when set, is the temporary directory the migrations have
+	// been fetched into, removed once closed.
+	tmpDir string
+
+	lastDuration time.Duration
+	lastOutcome  string
+	errorCount   int
+
+	cache versionCache
+}
+
+// versionCache holds the last version read from the database, so that
+// rapid probes do not each hit it.
+type versionCache struct {
+	mu    sync.Mutex
+	vers  uint
+	dirty bool
+	err   error
+	at    time.Time
+
+	// known is the last version read successfully.
+	known *knownVersion
+}
+
+type knownVersion struct {
+	vers  uint
+	dirty bool
+}
+
+// version returns the version of the database, as read at most
+// VERSION_CACHE_TTL ago, or last read by the background refresh when
+// VERSION_REFRESH_INTERVAL is set.
+func (t *target) version() (uint, bool, error) {
+	ttl := t.cfg.versionCacheTTL
+	refreshed := t.cfg.versionRefreshInterval > 0
+
+	c := &t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.at.IsZero() || (!refreshed && since(c.at) >= ttl) {
+		t.readVersion()
+	}
+	return c.vers, c.dirty, c.err
+}
+
+// readVersion reads the version of the database into the cache, whose lock
+// must be held. When the connection turns out to be closed by the database,
+// e.g. after its wait_timeout or a restart, the version is read again once
+// with a new one.
+func (t *target) readVersion() {
+	t.cache.read(t.name, t.readerVersion)
+	if !isBadConn(t.cache.err) {
+		return
+	}
+
+	slog.Warn("Lost the connection reading the version, reconnecting", "database", t.name, "err", t.cache.err)
+	if err := t.openVersionReader(t.cfg.migrationsPath()); err != nil {
+		slog.Error("Failed to reconnect", "database", t.name, "err", err)
+		return
+	}
+	t.cache.read(t.name, t.readerVersion)
+}
+
+// lastKnownVersion returns the last version read successfully, if any.
+func (t *target) lastKnownVersion() (knownVersion, bool) {
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+
+	if t.cache.known == nil {
+		return knownVersion{}, false
+	}
+	return *t.cache.known, true
+}
+
+// refreshVersion reads the version of the database into the cache.
+func (t *target) refreshVersion() error {
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+
+	t.readVersion()
+	return t.cache.err
+}
+
+// read reads the version of the database name with version, logging when it
+// turns dirty or clean again.
+func (c *versionCache) read(name string, version func() (uint, bool, error)) {
+	wasDirty := c.known != nil && c.known.dirty
+
+	c.vers, c.dirty, c.err = version()
+	c.at = now()
+	if c.err != nil {
+		return
+	}
+	c.known = &knownVersion{vers: c.vers, dirty: c.dirty}
+
+	switch {
+	case c.dirty && !wasDirty:
+		slog.Error("Database turned dirty, reporting it as not ready", "database", name, "version", c.vers)
+	case !c.dirty && wasDirty:
+		slog.Info("Database no longer dirty, reporting it as ready", "database", name, "version", c.vers)
+	}
+}
+
+// readerVersion reads the version with the migrate instance the version is
+// read with, which is not replaced meanwhile.
+func (t *target) readerVersion() (uint, bool, error) {
+	t.vmMu.RLock()
+	defer t.vmMu.RUnlock()
+
+	if t.vm != nil {
+		return t.vm.Version()
+	}
+	return t.m.Version()
+}
+
+// openVersionReader replaces the instance the version is read with, connected
+// to the DB_READ_URL replica if set, or with the regular credentials. On
+// failure, the version is read with m.
+//
+// The replaced instance is closed once no longer in use.
+func (t *target) openVersionReader(sourceURL string) (err error) {
+	var vm *migrate.Migrate
+	defer func() {
+		t.vmMu.Lock()
+		replaced := t.vm
+		t.vm = vm
+		t.vmMu.Unlock()
+
+		if replaced != nil {
+			replaced.Close()
+		}
+	}()
+
+	c := t.cfg
+	if c.readURL != "" {
+		// NOTE: the replica is connected to with the credentials of
+		// DB_READ_URL only.
+		c.dbURL, c.urlConfig, c.tokens = c.readURL, c.readConfig, nil
+	}
+	vm, err = newMigrate(sourceURL, c, nil)
+	return err
+}
+
+// invalidateVersion makes the next call to version read from the database.
+func (t *target) invalidateVersion() {
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	t.cache.at = time.Time{}
+}
+
+// Server serves the version of the databases migrated by Run.
+type Server struct {
+	cfg Config
+
+	// mu guards the migrate instances of the targets, which get replaced
+	// when migrations are re-run.
+	mu      sync.RWMutex
+	targets []*target
+
+	// failed holds, by name, the scrubbed error of the databases that could
+	// not be migrated with CONTINUE_ON_ERROR, reported in place of their
+	// version.
+	failed map[string]string
+
+	pathPrefix string
+	fieldStyle string
+	accessLog  bool
+	trustProxy bool
+	started    time.Time
+
+	// migrating is set until the initial migrations have completed.
+	migrating atomic.Bool
+}
+
+// handler returns the handler serving the routes registered by the given
+// functions, mounted under the configured path prefix.
+func (s *Server) handler(routes ...func(*http.ServeMux)) http.Handler {
+	mux := http.NewServeMux()
+	for _, register := range routes {
+		register(mux)
+	}
+
+	var h http.Handler = mux
+	if s.pathPrefix != "" {
+		prefixed := http.NewServeMux()
+		prefixed.Handle(s.pathPrefix+"/", http.StripPrefix(s.pathPrefix, mux))
+		h = prefixed
+	}
+
+	h = withGzip(h)
+	if s.accessLog {
+		h = withAccessLog(h, s.trustProxy)
+	}
+	return h
+}
+
+// publicRoutes registers the routes served on the main port.
+func (s *Server) publicRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/wait", s.wait)
+	mux.HandleFunc("/", s.ready(s.version))
+}
+
+// adminRoutes registers the read-only routes served on the admin port, if
+// configured, or on the main port otherwise.
+func (s *Server) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/stats", s.ready(s.stats))
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.HandleFunc("/history", s.ready(s.history))
+}
+
+// controlRoutes registers the routes changing the state of the databases or
+// of the rendered files, which are only served on the admin port, as they are not authenticated.
+func (s *Server) controlRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/migrate", s.ready(s.migrateTo))
+	mux.HandleFunc("/force", s.ready(s.force))
+	mux.HandleFunc("/render", s.ready(s.render))
+}
+
+// ready wraps h to answer with 503 and status migrating until the initial
+// migrations have completed.
+func (s *Server) ready(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.migrating.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"status": "migrating",
+			})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// refreshVersions reads the version of every database into its cache at the
+// given interval, until ctx is done.
+func (s *Server) refreshVersions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.RLock()
+		for _, t := range s.targets {
+			if err := t.refreshVersion(); err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+				slog.Warn("Failed to refresh version", "database", t.name, "err", err)
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// watchMigrations re-runs the migrations of the databases whose source gained
+// new versions, checking at the given interval until ctx is done. A check is
+// skipped while the migrations are being run otherwise, e.g. on SIGHUP.
+//
+// Sources fetched from git or extracted from archives are not fetched again,
+// only the local copy is checked, and new templates are only rendered along
+// with the new migration files.
+func (s *Server) watchMigrations(ctx context.Context, interval time.Duration) {
+	// NOTE: the sources are polled, rather than watched for file events,
+	// which are not delivered on some of the volumes migrations are mounted
+	// from, e.g. network filesystems and Kubernetes ConfigMaps.
+	latest := map[*target]uint{}
+	latestVersion := func(t *target) (uint, error) {
+		versions, err := availableVersions(t.cfg.migrationsPath())
+		if err != nil || len(versions) == 0 {
+			return 0, err
+		}
+		return versions[len(versions)-1], nil
+	}
+
+	s.mu.RLock()
+	for _, t := range s.targets {
+		latest[t], _ = latestVersion(t)
+	}
+	s.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.mu.TryLock() {
+			slog.Debug("Migrations being run, skipping the check for new ones")
+			continue
+		}
+		for _, t := range s.targets {
+			version, err := latestVersion(t)
+			if err != nil {
+				slog.Warn("Failed to check for new migrations", "database", t.name, "err", err)
+				continue
+			}
+			if version <= latest[t] {
+				continue
+			}
+			// NOTE: the new migrations are picked up again by the first
+			// check once the window opens.
+			if w := t.cfg.window; w != nil && !w.contains(now()) {
+				slog.Debug("New migrations found outside of the migration window", "database", t.name, "latestVersion", version, "window", w.String())
+				continue
+			}
+			latest[t] = version
+
+			slog.Info("New migrations found, migrating", "database", t.name, "latestVersion", version)
+			if err := t.migrate(ctx, false); err != nil {
+				slog.Error("Failed to apply the new migrations", "database", t.name, "err", err)
+				continue
+			}
+			slog.Info("New migrations applied", "database", t.name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeReadyFile writes the version of the databases to the file at path,
+// keyed by name as in the version response when more than one is configured.
+// A database with no migration applied has version 0.
+func (s *Server) writeReadyFile(path string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var b strings.Builder
+	for _, t := range s.targets {
+		current, _, err := versionOrNil(t.readerVersion())
+		if err != nil {
+			return err
+		}
+		var vers uint
+		if current != nil {
+			vers = *current
+		}
+
+		if len(s.targets) == 1 && t.name == "" {
+			fmt.Fprintln(&b, vers)
+			break
+		}
+		fmt.Fprintf(&b, "%s %d\n", t.name, vers)
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// Close closes the connections to the databases, and removes the migrations
+// fetched into temporary directories.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, t := range s.targets {
+		for _, m := range []*migrate.Migrate{t.m, t.vm} {
+			if m != nil {
+				srcErr, dbErr := m.Close()
+				errs = append(errs, srcErr, dbErr)
+			}
+		}
+		errs = append(errs, t.db.Close())
+		if t.tmpDir != "" {
+			errs = append(errs, os.RemoveAll(t.tmpDir))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listen binds the TCP address addr or, when socket is set, the Unix socket
+// at the path addr, replacing a stale one left by a previous run. The socket
+// file is removed once the listener is closed.
+func listen(addr string, socket bool) (net.Listener, error) {
+	if !socket {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", addr); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %q already in use", addr)
+		}
+		if err := os.Remove(addr); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", addr)
+}
+
+// serve runs the given servers on the respective listeners until any of them
+// fails or ctx is done, then shuts all of them down gracefully.
+func serve(ctx context.Context, servers []*http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		srv.BaseContext = func(net.Listener) context.Context { return ctx }
+		go func() {
+			slog.Info("Listening", "addr", srv.Addr)
+			errs <- srv.Serve(listeners[i])
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		slog.Info("Context done, shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	return err
+}
+
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plain := acceptsPlainText(r)
+
+	if msg, ok := s.failed[""]; ok {
+		http.Error(w, "Failed to migrate: "+msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(s.targets) != 1 || s.targets[0].name != "" {
+		s.versions(w, plain)
+		return
+	}
+
+	vers, dirty, stale, err := s.targetVersion(s.targets[0])
+	if err != nil {
+		if errors.Is(err, migrate.ErrNilVersion) {
+			slog.Info("No migration to be performed")
+			http.Error(w, "No migration to be performed", http.StatusExpectationFailed)
+			return
+		}
+		slog.Error("Failed to get version", "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if t := s.targets[0]; t.lastOutcome != "" {
+		w.Header().Set("X-Last-Migrate-Duration", t.lastDuration.Round(time.Millisecond).String())
+		w.Header().Set("X-Last-Migrate-Outcome", t.lastOutcome)
+	}
+	if plain {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, vers)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(s.versionFields(vers, dirty, stale))
+}
+
+// acceptsPlainText reports whether the client asked for text/plain rather
+// than JSON, the default.
+func acceptsPlainText(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			switch strings.TrimSpace(mediaType) {
+			case "text/plain":
+				return true
+			case "application/json":
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// targetVersion returns the version of the database of t. With
+// VERSION_STALE_OK, the last known version is returned, flagged as stale, when
+// the database cannot be reached.
+func (s *Server) targetVersion(t *target) (vers uint, dirty, stale bool, err error) {
+	vers, dirty, err = t.version()
+	if err == nil || errors.Is(err, migrate.ErrNilVersion) || !s.cfg.versionStaleOK {
+		return
+	}
+
+	known, ok := t.lastKnownVersion()
+	if !ok {
+		return
+	}
+	slog.Warn("Failed to get version, serving the last known one", "database", t.name, "err", err)
+	return known.vers, known.dirty, true, nil
+}
+
+// versionFields returns the body of the version response, with the keys
+// named according to the configured JSON_FIELD_STYLE. The stale field is only
+// present when set.
+func (s *Server) versionFields(vers uint, dirty, stale bool) map[string]any {
+	var fields map[string]any
+	switch s.fieldStyle {
+	case fieldStyleSnakeCase:
+		fields = map[string]any{
+			"current_version": vers,
+			"is_dirty":        dirty,
+		}
+	case fieldStyleCamelCase:
+		fields = map[string]any{
+			"currentVersion": vers,
+			"isDirty":        dirty,
+		}
+	default:
+		fields = map[string]any{
+			"version": vers,
+			"dirty":   dirty,
+		}
+	}
+	if stale {
+		fields["stale"] = true
+	}
+	return fields
+}
+
+// versions reports the version of every database, keyed by name. In plain
+// text, each line holds the name of a database and its version, or the error.
+// The databases that failed to migrate are reported with their error.
+func (s *Server) versions(w http.ResponseWriter, plain bool) {
+	result := make(map[string]any, len(s.targets)+len(s.failed))
+	var lines []string
+	for name, msg := range s.failed {
+		result[name] = map[string]any{"error": msg}
+		lines = append(lines, fmt.Sprintf("%s error: %s", name, msg))
+	}
+	slices.Sort(lines)
+	for _, t := range s.targets {
+		vers, dirty, stale, err := s.targetVersion(t)
+		switch {
+		case errors.Is(err, migrate.ErrNilVersion):
+			result[t.name] = map[string]any{"error": "No migration to be performed"}
+			lines = append(lines, fmt.Sprintf("%s error: No migration to be performed", t.name))
+		case err != nil:
+			slog.Error("Failed to get version", "database", t.name, "err", err)
+			result[t.name] = map[string]any{"error": "Internal error"}
+			lines = append(lines, fmt.Sprintf("%s error: Internal error", t.name))
+		default:
+			result[t.name] = s.versionFields(vers, dirty, stale)
+			lines = append(lines, fmt.Sprintf("%s %d", t.name, vers))
+		}
+	}
+
+	if plain {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// rerun re-renders the templates and applies the migrations of all the
+// targets, without overlapping with other runs or version reads. With
+// WAIT_FOR_WINDOW, the migration window is waited for before taking the lock,
+// so that the version keeps being served meanwhile.
+func (s *Server) rerun(ctx context.Context) {
+	s.mu.RLock()
+	targets := slices.Clone(s.targets)
+	s.mu.RUnlock()
+
+	for _, t := range targets {
+		if t.cfg.window != nil && t.cfg.waitForWindow {
+			if err := waitForWindow(ctx, t.cfg.window, true); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		err := t.migrate(ctx, false)
+		s.mu.Unlock()
+		if err != nil {
+			slog.Error("Failed to re-run migrations", "database", t.name, "err", err)
+			continue
+		}
+		slog.Info("Migrations re-run", "database", t.name)
+	}
+}
+
+// stats reports basic figures about the migrations, keyed by database name
+// when more than one is configured.
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uptime := int64(since(s.started).Seconds())
+	result := make(map[string]any, len(s.targets))
+	for _, t := range s.targets {
+		stats := map[string]any{
+			"currentVersion":        nil,
+			"dirty":                 false,
+			"uptimeSeconds":         uptime,
+			"lastMigrateDurationMs": t.lastDuration.Milliseconds(),
+			"migrateErrorCount":     t.errorCount,
+		}
+
+		vers, dirty, err := t.readerVersion()
+		if err == nil {
+			stats["currentVersion"] = vers
+			stats["dirty"] = dirty
+		} else if !errors.Is(err, migrate.ErrNilVersion) {
+			slog.Error("Failed to get version", "database", t.name, "err", err)
+		}
+
+		if len(s.targets) == 1 && t.name == "" {
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(stats)
+			return
+		}
+		result[t.name] = stats
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// healthz is a cheap liveness check, reporting the status as migrating until
+// the initial migrations have completed and ready afterwards. When called with
+// deep=1 it behaves like readyz.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("deep") == "1" {
+		s.readyz(w, r)
+		return
+	}
+
+	status := "ready"
+	if s.migrating.Load() {
+		status = "migrating"
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+	})
+}
+
+// readyz pings the databases and reports them as unavailable if any is
+// unreachable, as dirty if any is, or as migrating until the initial
+// migrations have completed.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.migrating.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+			"status": "migrating",
+		})
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), defaultPingTimeout)
+	defer cancel()
+
+	start := now()
+	var err error
+	for _, t := range s.targets {
+		if err = t.db.PingContext(ctx); err != nil {
+			break
+		}
+	}
+	latency := since(start)
+
+	w.Header().Set("content-type", "application/json")
+	if err != nil {
+		slog.Warn("Database unreachable", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    "unavailable",
+			"latencyMs": latency.Milliseconds(),
+		})
+		return
+	}
+
+	for _, t := range s.targets {
+		if _, dirty, err := t.version(); err == nil && dirty {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]any{
+				"status":    "dirty",
+				"latencyMs": latency.Milliseconds(),
+			})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "ok",
+		"latencyMs": latency.Milliseconds(),
+	})
+}
+
+// wait blocks until every database is at the latest version available in its
+// source and not dirty, or the timeout given as query parameter expires.
+func (s *Server) wait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxWaitTimeout {
+			http.Error(w, fmt.Sprintf("Invalid timeout: must be a positive duration up to %s", maxWaitTimeout), http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(defaultWaitInterval)
+	defer ticker.Stop()
+
+	w.Header().Set("content-type", "application/json")
+	for {
+		if s.upToDate() {
+			json.NewEncoder(w).Encode(map[string]any{
+				"status": "up-to-date",
+			})
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]any{
+				"status": "pending",
+			})
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// upToDate reports whether every database is at the latest version available
+// in its source and not dirty.
+func (s *Server) upToDate() bool {
+	if s.migrating.Load() {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.targets {
+		available, err := availableVersions(t.cfg.migrationsPath())
+		if err != nil {
+			slog.Warn("Failed to list the migrations", "database", t.name, "err", err)
+			return false
+		}
+
+		current, dirty, err := versionOrNil(t.readerVersion())
+		if err != nil {
+			slog.Warn("Failed to get version", "database", t.name, "err", err)
+			return false
+		}
+
+		if dirty {
+			return false
+		}
+		if len(available) == 0 {
+			continue
+		}
+		if current == nil || *current != available[len(available)-1] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,67 @@
+package migrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// defaultTagsManifest is the name of the manifest looked for in the
+// migrations directory when MIGRATE_TAGS_MANIFEST is not set.
+const defaultTagsManifest = "tags.json"
+
+// loadTagsManifest reads the manifest at path, a JSON object mapping versions
+// to their list of tags, e.g. {"3": ["post-deploy"]}.
+func loadTagsManifest(path string) (map[uint][]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tags manifest: %w", err)
+	}
+
+	var raw map[string][]string
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse tags manifest %q: %w", path, err)
+	}
+
+	manifest := make(map[uint][]string, len(raw))
+	for key, tags := range raw {
+		version, err := strconv.ParseUint(key, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q in tags manifest %q", key, path)
+		}
+		manifest[uint(version)] = tags
+	}
+
+	return manifest, nil
+}
+
+// tagsManifest returns the path of the manifest tagging the migrations.
+func (c Config) tagsManifest() string {
+	if c.migrateTagsManifest != "" {
+		return c.migrateTagsManifest
+	}
+	return filepath.Join(c.migrations, defaultTagsManifest)
+}
+
+// selectTagged returns the pending versions to be applied for the given
+// tags. Untagged migrations are always applied. As the versions are applied
+// in order, selection stops at the first migration with none of the tags,
+// which has to wait for a run with its own tags.
+func selectTagged(pending []uint, manifest map[uint][]string, tags []string) []uint {
+	for i, v := range pending {
+		vTags, ok := manifest[v]
+		if !ok || slices.ContainsFunc(vTags, func(tag string) bool {
+			return slices.Contains(tags, tag)
+		}) {
+			continue
+		}
+
+		slog.Info("Stopping before a migration with other tags", "version", v, "tags", vTags, "selected", tags)
+		return pending[:i]
+	}
+	return pending
+}
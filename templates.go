@@ -0,0 +1,695 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+const (
+	directiveOutputDir = "output-dir"
+	directiveFilename  = "filename"
+)
+
+var knownDirectives = map[string]bool{
+	directiveOutputDir: true,
+	directiveFilename:  true,
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// minSecretLength is the length under which the values of sensitive
+// variables are not looked for in the outputs, as they would match by chance.
+const minSecretLength = 4
+
+// defaultTemplateEnvMax is the number of variables exposed to the templates
+// above which a warning is logged.
+const defaultTemplateEnvMax = 500
+
+// defaultMaxFileSize is the MAX_MIGRATION_FILE_SIZE unless set, generous
+// enough to only catch runaway templates.
+const defaultMaxFileSize = 50 << 20
+
+var sensitiveSuffixes = []string{"_PASSWORD", "_SECRET", "_TOKEN"}
+
+// includeCall matches the calls to include with a literal path, whose files
+// are hashed along with the template in the RENDER_STATE_FILE.
+var includeCall = regexp.MustCompile(`\binclude\s+"([^"]+)"`)
+
+// renderOptions tweaks how the output of the templates is written.
+type renderOptions struct {
+	// normalizeLineEndings converts CRLF line endings to LF.
+	normalizeLineEndings bool
+	// secrets are the values of the sensitive variables, by name, which
+	// should not end up in the outputs.
+	secrets map[string]string
+	// strictSecrets fails the rendering, instead of warning, when an output
+	// contains a secret.
+	strictSecrets bool
+	// stateFile records the renders, so that unchanged templates are not
+	// rendered again.
+	stateFile string
+	// concurrency is the number of templates rendered at the same time.
+	concurrency int
+	// overwrite lets the outputs replace files not rendered from the same
+	// template.
+	overwrite bool
+	// clean removes the files generated by the previous renders before
+	// rendering.
+	clean bool
+
+	// strict renders all the templates, or none of them.
+	strict bool
+	// confine writes all the outputs under the destination directory, the
+	// absolute output-dir directives included, e.g. for the render check.
+	confine bool
+	// existed, when set, is filled with the outputs that exist before
+	// rendering, wherever the output-dir directives put them.
+	existed map[string]bool
+
+	// generated is set by renderTemplates unless overwrite is, and checked
+	// before writing each output. It is also set, to be cleaned, with clean.
+	generated *generatedFiles
+	// stageDir is set by renderTemplates in strict mode, the outputs are
+	// written there at first.
+	stageDir string
+}
+
+func (c Config) renderOptions() renderOptions {
+	return renderOptions{
+		normalizeLineEndings: c.normalizeLineEndings,
+		secrets:              c.secrets(),
+		strictSecrets:        c.strictSecrets,
+		stateFile:            c.renderStateFile,
+		concurrency:          c.renderConcurrency,
+		overwrite:            c.renderOverwrite,
+		clean:                c.cleanRenderDir,
+		strict:               c.templateStrict,
+	}
+}
+
+// secrets returns the values of DB_PASS and of all the variables named like
+// *_PASSWORD, *_SECRET or *_TOKEN, whether exposed to the templates or not.
+func (c Config) secrets() map[string]string {
+	secrets := map[string]string{}
+	for name, value := range envToMap() {
+		for _, suffix := range sensitiveSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				secrets[name] = value
+			}
+		}
+	}
+	if c.dbPass != "" {
+		secrets["DB_PASS"] = c.dbPass
+	}
+	return secrets
+}
+
+// leakedSecrets returns, sorted, the names of the secrets whose value is
+// found in output.
+func leakedSecrets(output []byte, secrets map[string]string) []string {
+	var leaked []string
+	for name, value := range secrets {
+		if len(value) >= minSecretLength && bytes.Contains(output, []byte(value)) {
+			leaked = append(leaked, name)
+		}
+	}
+	slices.Sort(leaked)
+	return leaked
+}
+
+// render renders the templates into the migrations directory, then runs the
+// POST_RENDER_CMD over it, if set.
+func (c Config) render() ([]string, error) {
+	return c.renderInto(c.migrations, c.renderOptions())
+}
+
+// renderInto renders the templates into dir with opts, followed by the
+// POST_RENDER_CMD and the size checks, and returns the paths written.
+func (c Config) renderInto(dir string, opts renderOptions) ([]string, error) {
+	written, err := renderTemplates(c.templates, dir, c.templateEnv(), opts)
+	if err != nil {
+		return written, err
+	}
+
+	if len(c.postRenderCmd) > 0 {
+		if err := runPostRender(c.postRenderCmd, dir); err != nil {
+			return written, err
+		}
+	}
+
+	if c.maxFileSize > 0 {
+		if err := checkFileSizes(written, c.maxFileSize); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// renderCopy renders the templates into a temporary copy of the migrations
+// directory, leaving the directory and the render state untouched, and returns
+// the copy, to be removed by the caller also on failure.
+func (c Config) renderCopy() (string, error) {
+	dir, err := os.MkdirTemp("", "migrator-copy-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(c.migrations); err == nil {
+		if err := copyDir(c.migrations, dir); err != nil {
+			return dir, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return dir, err
+	}
+
+	opts := c.renderOptions()
+	opts.stateFile = ""
+	opts.confine = true
+	_, err = c.renderInto(dir, opts)
+	return dir, err
+}
+
+// renderCheck renders the templates twice, into temporary directories, and
+// reports an error if the outputs differ, e.g. because of a template ranging
+// over unordered data. Nothing is written outside of those directories.
+func renderCheck(c Config) error {
+	opts := c.renderOptions()
+	opts.stateFile = ""
+	opts.clean = false
+	opts.confine = true
+
+	var outputs [2]map[string][]byte
+	for i := range outputs {
+		dir, err := os.MkdirTemp("", "migrator-render-check-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		written, err := renderTemplates(c.templates, dir, c.templateEnv(), opts)
+		if err != nil {
+			return err
+		}
+
+		outputs[i] = map[string][]byte{}
+		for _, path := range written {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			outputs[i][rel] = content
+		}
+	}
+
+	var errs []error
+	for name, first := range outputs[0] {
+		second, ok := outputs[1][name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%q rendered only once", name))
+			continue
+		}
+		if !bytes.Equal(first, second) {
+			removed, added := lineDiff(first, second)
+			maskSecrets(removed, opts.secrets)
+			maskSecrets(added, opts.secrets)
+			slog.Error("Template output differs across renders", "output", name, "first", removed, "second", added)
+			errs = append(errs, fmt.Errorf("%q differs across renders", name))
+		}
+	}
+	for name := range outputs[1] {
+		if _, ok := outputs[0][name]; !ok {
+			errs = append(errs, fmt.Errorf("%q rendered only once", name))
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// checkFileSizes verifies that none of the given files is larger than limit
+// bytes.
+func checkFileSizes(paths []string, limit int64) error {
+	var errs []error
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if info.Size() > limit {
+			errs = append(errs, fmt.Errorf("rendered file %q is %d bytes, larger than the MAX_MIGRATION_FILE_SIZE of %d", path, info.Size(), limit))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runPostRender runs the given command with dir as last argument, logging
+// its output.
+func runPostRender(command []string, dir string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], append(command[1:], dir)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	slog.Info("Post-render command run", "cmd", cmd.String(), "stdout", stdout.String(), "stderr", stderr.String())
+	if err != nil {
+		return fmt.Errorf("post-render command failed: %w", err)
+	}
+
+	return nil
+}
+
+// renderCommand implements "render -", rendering the template read from
+// stdin to stdout. The template is rendered against the environment, extended
+// with the values of the JSON object in the file given as second argument, if
+// any.
+func renderCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || len(args) > 2 || args[0] != "-" {
+		return errors.New("usage: render - [values.json]")
+	}
+
+	if err := loadEnvFile(); err != nil {
+		return &ConfigError{Var: "ENV_FILE", Err: err}
+	}
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			return &ConfigError{Var: "CONFIG_FILE", Err: err}
+		}
+	}
+
+	var c Config
+	if err := c.readRenderConfig(); err != nil {
+		return err
+	}
+	envs := c.templateEnv()
+
+	if len(args) == 2 {
+		values, err := loadValuesFile(args[1])
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			envs[k] = v
+		}
+	}
+
+	text, err := io.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read the template: %w", err)
+	}
+
+	dir := getenv("TEMPLATES")
+	if dir == "" {
+		dir = "."
+	}
+
+	tmpl, err := template.New("stdin").Funcs(templateFuncs(dir)).Parse(string(text))
+	if err != nil {
+		return &TemplateError{Name: "stdin", Kind: ErrTemplateParse, Err: err}
+	}
+
+	output, err := renderOutput(tmpl, envs, c.renderOptions(), slog.Default())
+	if err != nil {
+		return err
+	}
+
+	_, err = stdout.Write(output)
+	return err
+}
+
+// stagedPath returns the path output is written at in stageDir.
+func stagedPath(stageDir, output string) string {
+	sum := sha256.Sum256([]byte(output))
+	return filepath.Join(stageDir, hex.EncodeToString(sum[:]))
+}
+
+// commitStaged moves the staged outputs of the templates into place, unless
+// any failed to render, in which case their errors are returned and nothing
+// is moved.
+func commitStaged(list []*template.Template, results []renderResult, paths map[string]string, stageDir string) error {
+	var errs []error
+	for i, tmpl := range list {
+		if err := results[i].err; err != nil {
+			errs = append(errs, fmt.Errorf("failed to render template %q: %w", tmpl.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("no template rendered: %w", errors.Join(errs...))
+	}
+
+	for i, tmpl := range list {
+		if results[i].change == renderSkipped {
+			continue
+		}
+		output := paths[tmpl.Name()]
+		if err := moveFile(stagedPath(stageDir, output), output); err != nil {
+			return fmt.Errorf("failed to move the output of template %q into place: %w", tmpl.Name(), err)
+		}
+	}
+	return nil
+}
+
+// moveFile renames src to dst, copying it when they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, 0o666)
+}
+
+// How the render of a template changed its output.
+const (
+	renderAdded     = "added"
+	renderModified  = "modified"
+	renderUnchanged = "unchanged"
+	renderSkipped   = "skipped"
+)
+
+// logRenderChange logs how the file at path changed from previous, if it
+// existed, to output, and returns the change. The lines removed and added are
+// only logged at debug level, with the secrets masked.
+func logRenderChange(log *slog.Logger, path string, previous []byte, existed bool, output []byte, secrets map[string]string) string {
+	switch {
+	case !existed:
+		log.Debug("Rendered file added", "output", path, "size", len(output))
+		return renderAdded
+	case bytes.Equal(previous, output):
+		log.Debug("Rendered file unchanged", "output", path)
+		return renderUnchanged
+	}
+
+	log.Info("Rendered file modified", "output", path, "sizeDelta", len(output)-len(previous))
+	if log.Enabled(context.Background(), slog.LevelDebug) {
+		removed, added := lineDiff(previous, output)
+		maskSecrets(removed, secrets)
+		maskSecrets(added, secrets)
+		log.Debug("Rendered file diff", "output", path, "removed", removed, "added", added)
+	}
+	return renderModified
+}
+
+// maskSecrets replaces the secrets found in lines with ***, in place.
+func maskSecrets(lines []string, secrets map[string]string) {
+	for i, line := range lines {
+		for _, secret := range secrets {
+			if len(secret) >= minSecretLength {
+				line = strings.ReplaceAll(line, secret, "***")
+			}
+		}
+		lines[i] = line
+	}
+}
+
+// lineDiff returns the lines of previous missing from output and the lines of
+// output missing from previous, regardless of their position. The line
+// endings are not compared, so that switching between CRLF and LF does not
+// report every line.
+func lineDiff(previous, output []byte) (removed, added []string) {
+	lines := func(content []byte) []string {
+		split := strings.Split(string(content), "\n")
+		for i, line := range split {
+			split[i] = strings.TrimSuffix(line, "\r")
+		}
+		return split
+	}
+
+	counts := map[string]int{}
+	for _, line := range lines(previous) {
+		counts[line]++
+	}
+	for _, line := range lines(output) {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		added = append(added, line)
+	}
+	for _, line := range lines(previous) {
+		if counts[line] > 0 {
+			counts[line]--
+			removed = append(removed, line)
+		}
+	}
+	return removed, added
+}
+
+// templateFuncs returns the functions available to the templates in dir.
+func templateFuncs(dir string) template.FuncMap {
+	return template.FuncMap{
+		"include": includeFunc(dir),
+	}
+}
+
+// includeFunc returns the include function, inserting the content of the
+// file at a path relative to dir, optionally indenting each line by the given
+// number of spaces, as in {{ include "seeds/users.sql" 4 }}.
+func includeFunc(dir string) func(string, ...int) (string, error) {
+	return func(path string, indent ...int) (string, error) {
+		if len(indent) > 1 {
+			return "", fmt.Errorf("include %q: at most one indentation expected", path)
+		}
+
+		full, err := includePath(dir, path)
+		if err != nil {
+			return "", err
+		}
+		content, err := os.ReadFile(full)
+		if err != nil {
+			return "", fmt.Errorf("include %q: %w", path, err)
+		}
+
+		if len(indent) == 0 || indent[0] <= 0 {
+			return string(content), nil
+		}
+		pad := strings.Repeat(" ", indent[0])
+		lines := strings.Split(string(content), "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = pad + line
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+}
+
+// includePath returns the path of the file included as path from the
+// templates in dir, refusing the ones leading outside of it, symlinks
+// included.
+func includePath(dir, path string) (string, error) {
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("include %q: outside of the templates directory", path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+	if err != nil {
+		return "", fmt.Errorf("include %q: %w", path, err)
+	}
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("include %q: %w", path, err)
+	}
+	if rel, err := filepath.Rel(base, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("include %q: outside of the templates directory", path)
+	}
+
+	return resolved, nil
+}
+
+// loadValuesFile reads a JSON object of values, converted like the ones of
+// the CONFIG_FILE.
+func loadValuesFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read values file: %w", err)
+	}
+
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to parse values file %q: %w", path, err)
+	}
+
+	return flattenValues(raw)
+}
+
+// templateDirectives parses the header of the template at path, made of
+// comment lines like "-- output-dir: /seeds". Parsing stops at the first line
+// that is not a directive. The output-dir is interpolated like in CONFIG_FILE.
+func templateDirectives(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	directives := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for first := true; scanner.Scan(); first = false {
+		text := scanner.Text()
+		if first {
+			text = strings.TrimPrefix(text, string(utf8BOM))
+		}
+		line, ok := strings.CutPrefix(strings.TrimSpace(text), "--")
+		if !ok {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || !knownDirectives[key] {
+			break
+		}
+		value = strings.TrimSpace(value)
+		if key == directiveOutputDir {
+			if value, err = interpolate(value); err != nil {
+				return nil, fmt.Errorf("directive %q: %w", key, err)
+			}
+		}
+		directives[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return directives, nil
+}
+
+// outputPath returns the path the template at path renders into. The
+// directory is dstDir unless overridden by the output-dir directive, with
+// relative directories resolved against dstDir. The file name is the one of
+// the template without the .tmpl extension, unless overridden by the filename
+// directive, which is itself rendered against envs. With confine, every
+// output-dir is resolved against dstDir, so that the output stays under it.
+func outputPath(path, dstDir string, envs map[string]string, confine bool) (string, error) {
+	directives, err := templateDirectives(path)
+	if err != nil {
+		return "", err
+	}
+
+	dir := dstDir
+	if d := directives[directiveOutputDir]; d != "" {
+		switch {
+		case confine:
+			// NOTE: rooted first, so that .. cannot climb out of dstDir.
+			d = filepath.Join(dstDir, filepath.Join(string(filepath.Separator), d))
+		case !filepath.IsAbs(d):
+			d = filepath.Join(dstDir, d)
+		}
+		dir = d
+	}
+
+	name := outputFileName(filepath.Base(path))
+	if text := directives[directiveFilename]; text != "" {
+		if name, err = renderFilename(text, envs); err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// renderFilename renders the filename directive, checking that the result is
+// a migration file name.
+func renderFilename(text string, envs map[string]string) (string, error) {
+	tmpl, err := template.New(directiveFilename).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("directive %q: %w", directiveFilename, err)
+	}
+
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, envs); err != nil {
+		return "", fmt.Errorf("directive %q: %w", directiveFilename, err)
+	}
+
+	name := strings.TrimSpace(buf.String())
+	if name != filepath.Base(name) {
+		return "", fmt.Errorf("directive %q: %q must not contain a directory", directiveFilename, name)
+	}
+	if _, err := source.Parse(name); err != nil {
+		return "", fmt.Errorf("directive %q: %q is not a migration file name: %w", directiveFilename, name, err)
+	}
+
+	return name, nil
+}
+
+// logBuffer is a slog.Handler holding the records until flushed to the
+// default logger, so that concurrent renders log in a reproducible order.
+type logBuffer struct {
+	records *bufferedRecords
+	attrs   []slog.Attr
+}
+
+type bufferedRecords struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{records: &bufferedRecords{}}
+}
+
+func (b *logBuffer) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Enabled(ctx, level)
+}
+
+func (b *logBuffer) Handle(_ context.Context, r slog.Record) error {
+	r = r.Clone()
+	r.AddAttrs(b.attrs...)
+
+	b.records.mu.Lock()
+	defer b.records.mu.Unlock()
+	b.records.records = append(b.records.records, r)
+	return nil
+}
+
+func (b *logBuffer) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logBuffer{records: b.records, attrs: append(slices.Clip(b.attrs), attrs...)}
+}
+
+// WithGroup is not supported, groups are ignored.
+func (b *logBuffer) WithGroup(string) slog.Handler {
+	return b
+}
+
+// flush writes the records to the default logger. It is a no-op on a nil
+// buffer.
+func (b *logBuffer) flush() {
+	if b == nil {
+		return
+	}
+
+	b.records.mu.Lock()
+	defer b.records.mu.Unlock()
+
+	handler := slog.Default().Handler()
+	for _, r := range b.records.records {
+		handler.Handle(context.Background(), r)
+	}
+	b.records.records = nil
+}
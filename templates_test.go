@@ -0,0 +1,125 @@
+package migrator
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"text/template"
+)
+
+// renderDir renders the templates, by name, into a new directory and returns
+// the content of the outputs, by name.
+func renderDir(t *testing.T, templates map[string]string, opts renderOptions) map[string][]byte {
+	t.Helper()
+
+	tmplDir, dstDir := t.TempDir(), t.TempDir()
+	for name, content := range templates {
+		if err := os.WriteFile(filepath.Join(tmplDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written, err := renderTemplates(tmplDir, dstDir, map[string]string{"NAME": "users"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := map[string][]byte{}
+	for _, path := range written {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[filepath.Base(path)] = content
+	}
+	return outputs
+}
+
+func TestRenderStripsBOM(t *testing.T) {
+	outputs := renderDir(t, map[string]string{
+		"1_init.up.sql.tmpl": "\ufeffCREATE TABLE {{ .NAME }} (id INT);\n",
+	}, renderOptions{})
+
+	output, ok := outputs["1_init.up.sql"]
+	if !ok {
+		t.Fatalf("1_init.up.sql not rendered, got %v", outputs)
+	}
+	if bytes.HasPrefix(output, utf8BOM) {
+		t.Errorf("output starts with a BOM: %q", output)
+	}
+	if want := "CREATE TABLE users (id INT);\n"; string(output) != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestRenderStripsBOMBeforeDirectives(t *testing.T) {
+	outputs := renderDir(t, map[string]string{
+		"1_init.up.sql.tmpl": "\ufeff-- filename: 1_{{ .NAME }}.up.sql\nCREATE TABLE {{ .NAME }} (id INT);\n",
+	}, renderOptions{})
+
+	output, ok := outputs["1_users.up.sql"]
+	if !ok {
+		t.Fatalf("filename directive ignored, got %v", outputs)
+	}
+	if bytes.HasPrefix(output, utf8BOM) {
+		t.Errorf("output starts with a BOM: %q", output)
+	}
+}
+
+func TestRenderLineEndings(t *testing.T) {
+	const crlf = "CREATE TABLE {{ .NAME }} (\r\n  id INT\r\n);\r\n"
+
+	tests := []struct {
+		name      string
+		normalize bool
+		want      string
+	}{
+		{"kept", false, "CREATE TABLE users (\r\n  id INT\r\n);\r\n"},
+		{"normalized", true, "CREATE TABLE users (\n  id INT\n);\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputs := renderDir(t, map[string]string{
+				"1_init.up.sql.tmpl": crlf,
+			}, renderOptions{normalizeLineEndings: tt.normalize})
+
+			if got := string(outputs["1_init.up.sql"]); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCRLFUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "1_init.up.sql")
+	if err := os.WriteFile(output, []byte("CREATE TABLE users (\n  id INT\n);\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := template.Must(template.New("1_init.up.sql.tmpl").Parse("CREATE TABLE {{ .NAME }} (\r\n  id INT\r\n);\r\n"))
+	opts := renderOptions{normalizeLineEndings: true}
+	change, err := renderTemplate(tmpl, map[string]string{"NAME": "users"}, output, opts, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change != renderUnchanged {
+		t.Errorf("change = %q, want %q", change, renderUnchanged)
+	}
+}
+
+func TestLineDiffLineEndings(t *testing.T) {
+	previous := []byte("CREATE TABLE users (\n  id INT\n);\n")
+	output := []byte("CREATE TABLE users (\r\n  id BIGINT\r\n);\r\n")
+
+	removed, added := lineDiff(previous, output)
+	if want := []string{"  id INT"}; !slices.Equal(removed, want) {
+		t.Errorf("removed = %q, want %q", removed, want)
+	}
+	if want := []string{"  id BIGINT"}; !slices.Equal(added, want) {
+		t.Errorf("added = %q, want %q", added, want)
+	}
+}
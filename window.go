@@ -0,0 +1,109 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// migrateWindow is the daily time range, set with MIGRATE_WINDOW, outside of
+// which no migration is applied.
+type migrateWindow struct {
+	// start and end are offsets from midnight, end is before start when the
+	// window spans midnight.
+	start time.Duration
+	end   time.Duration
+	loc   *time.Location
+}
+
+// parseWindow parses a window like "22:00-04:00 UTC". The location is an IANA
+// time zone name, UTC when omitted.
+func parseWindow(value string) (*migrateWindow, error) {
+	rng, zone, _ := strings.Cut(strings.TrimSpace(value), " ")
+	from, to, ok := strings.Cut(rng, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q must be like 22:00-04:00 UTC", value)
+	}
+
+	w := &migrateWindow{loc: time.UTC}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("%q is an empty window", value)
+	}
+
+	if zone = strings.TrimSpace(zone); zone != "" {
+		if w.loc, err = time.LoadLocation(zone); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: must be like 22:00", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls within the window.
+func (w *migrateWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	start, end := clockOn(t, 0, w.start), clockOn(t, 0, w.end)
+	if w.start < w.end {
+		return !t.Before(start) && t.Before(end)
+	}
+	return !t.Before(start) || t.Before(end)
+}
+
+// next returns the time the window opens next after t.
+func (w *migrateWindow) next(t time.Time) time.Time {
+	t = t.In(w.loc)
+	open := clockOn(t, 0, w.start)
+	if !open.After(t) {
+		open = clockOn(t, 1, w.start)
+	}
+	return open
+}
+
+// clockOn returns the time the clock reads offset from midnight, days after the
+// day of t. The offset is not added to midnight, as the day is an hour shorter
+// or longer when the clock changes for DST.
+func clockOn(t time.Time, days int, offset time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+days, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+// waitForWindow returns an error when the current time is outside of the
+// window or, when wait is set, sleeps until the window opens or ctx is done.
+func waitForWindow(ctx context.Context, w *migrateWindow, wait bool) error {
+	at := now()
+	if w.contains(at) {
+		return nil
+	}
+
+	open := w.next(at)
+	if !wait {
+		return fmt.Errorf("outside migration window %s, opening at %s", w, open.Format(time.RFC3339))
+	}
+
+	slog.Info("Waiting for the migration window to open", "window", w.String(), "opensAt", open)
+	return sleep(ctx, open.Sub(now()))
+}
+
+// String returns the window like it is configured.
+func (w *migrateWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%s-%s %s", clock(w.start), clock(w.end), w.loc)
+}
@@ -0,0 +1,201 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// rome is where the clock changes for DST on 2024-03-31 at 02:00, going
+// forward to 03:00, and on 2024-10-27 at 03:00, going back to 02:00.
+func rome(t *testing.T) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"22:00-04:00 UTC", "22:00-04:00 UTC", false},
+		{"22:00-04:00", "22:00-04:00 UTC", false},
+		{" 01:30-02:45  Europe/Rome ", "01:30-02:45 Europe/Rome", false},
+		{"22:00", "", true},
+		{"22-04", "", true},
+		{"22:00-24:00", "", true},
+		{"22:00-22:00", "", true},
+		{"22:00-04:00 Nowhere/Else", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			w, err := parseWindow(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWindow() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && w.String() != tt.want {
+				t.Errorf("parseWindow() = %s, want %s", w, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	loc := rome(t)
+
+	tests := []struct {
+		window string
+		at     time.Time
+		want   bool
+	}{
+		{"01:00-04:00 UTC", time.Date(2024, 3, 1, 0, 59, 59, 0, time.UTC), false},
+		{"01:00-04:00 UTC", time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC), true},
+		{"01:00-04:00 UTC", time.Date(2024, 3, 1, 3, 59, 59, 0, time.UTC), true},
+		{"01:00-04:00 UTC", time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC), false},
+		// The windows wrapping midnight.
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 21, 59, 59, 0, time.UTC), false},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC), true},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 3, 59, 59, 0, time.UTC), true},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC), false},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		// The time is read in the location of the window.
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 1, 21, 30, 0, 0, time.UTC), true},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 1, 3, 30, 0, 0, time.UTC), false},
+		// The days the clock changes for DST.
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 31, 3, 30, 0, 0, loc), true},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 31, 4, 0, 0, 0, loc), false},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 31, 22, 0, 0, 0, loc), true},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 31, 21, 59, 0, 0, loc), false},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 27, 3, 59, 0, 0, loc), true},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 27, 4, 0, 0, 0, loc), false},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 27, 22, 0, 0, 0, loc), true},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 27, 21, 59, 0, 0, loc), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.window+" "+tt.at.Format(time.RFC3339), func(t *testing.T) {
+			w, err := parseWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.at); got != tt.want {
+				t.Errorf("contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	loc := rome(t)
+
+	tests := []struct {
+		window string
+		at     time.Time
+		want   time.Time
+	}{
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC)},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 22, 0, 0, 0, time.UTC)},
+		{"22:00-04:00 UTC", time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 22, 0, 0, 0, time.UTC)},
+		{"22:00-04:00 UTC", time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 22, 0, 0, 0, time.UTC)},
+		// The days the clock changes for DST, which are an hour shorter and
+		// longer.
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 31, 12, 0, 0, 0, loc), time.Date(2024, 3, 31, 22, 0, 0, 0, loc)},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 3, 30, 23, 0, 0, 0, loc), time.Date(2024, 3, 31, 22, 0, 0, 0, loc)},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 27, 12, 0, 0, 0, loc), time.Date(2024, 10, 27, 22, 0, 0, 0, loc)},
+		{"22:00-04:00 Europe/Rome", time.Date(2024, 10, 26, 23, 0, 0, 0, loc), time.Date(2024, 10, 27, 22, 0, 0, 0, loc)},
+		{"01:00-02:00 Europe/Rome", time.Date(2024, 10, 27, 0, 30, 0, 0, loc), time.Date(2024, 10, 27, 1, 0, 0, 0, loc)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.window+" "+tt.at.Format(time.RFC3339), func(t *testing.T) {
+			w, err := parseWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.next(tt.at); !got.Equal(tt.want) {
+				t.Errorf("next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForWindow(t *testing.T) {
+	w, err := parseWindow("22:00-04:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		wait    bool
+		wantErr bool
+		slept   []time.Duration
+	}{
+		{"open", time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC), false, false, nil},
+		{"open after midnight", time.Date(2024, 3, 1, 3, 59, 0, 0, time.UTC), false, false, nil},
+		{"closed", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), false, true, nil},
+		{"closed waiting", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), true, false, []time.Duration{10 * time.Hour}},
+		{"closed at the end", time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC), true, false, []time.Duration{18 * time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slept := stubClock(t)
+			stubNow(t, tt.at)
+
+			err := waitForWindow(context.Background(), w, tt.wait)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitForWindow() = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(*slept, tt.slept) {
+				t.Errorf("slept %v, want %v", *slept, tt.slept)
+			}
+		})
+	}
+}
+
+func TestMigrateOutsideWindow(t *testing.T) {
+	dir := t.TempDir()
+	migrations, templates := filepath.Join(dir, "migrations"), filepath.Join(dir, "templates")
+	for _, d := range []string{migrations, templates} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(migrations, "1_init.up.sql"), []byte("CREATE TABLE a (id INT);"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := NewConfig(
+		WithDatabase("app", "secret", "127.0.0.1", 1, "app"),
+		WithMigrations(migrations),
+		WithTemplates(templates),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.window, err = parseWindow("22:00-04:00 UTC"); err != nil {
+		t.Fatal(err)
+	}
+	stubNow(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	err = (&target{cfg: cfg}).migrate(context.Background(), false)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Stage != stageWindow || exitErr.Code != 7 {
+		t.Errorf("migrate() = %v, want a window error with code 7", err)
+	}
+}